@@ -1,16 +1,22 @@
 package main
 
+//go:generate go run ./handlers_gen
+//go:generate go run ./example/gen api.go api_marshaller.go
+
 import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 )
 
 // вы можете использовать ApiError в коде, который получается в результате генерации
 // считаем что это какая-то общеизвестная структура
+// Code - машиночитаемый код ошибки, попадает в ответ в формате problem+json
 type ApiError struct {
 	HTTPStatus int
+	Code       string
 	Err        error
 }
 
@@ -18,6 +24,25 @@ func (ae ApiError) Error() string {
 	return ae.Err.Error()
 }
 
+func (ae ApiError) Unwrap() error {
+	return ae.Err
+}
+
+// результат метода может сам задать заголовки и статус успешного ответа,
+// статус из результата важнее "status" из apigen:api
+type ResultHeaders interface {
+	Headers() http.Header
+}
+
+type ResultStatus interface {
+	StatusCode() int
+}
+
+// ResultVersion - версия результата для ETag, без неё ETag считается по телу ответа
+type ResultVersion interface {
+	Version() string
+}
+
 // ----------------
 
 const (
@@ -26,7 +51,9 @@ const (
 	statusAdmin     = 20
 )
 
+// apigen:service {"cors": {"origins": ["https://app.example.com"], "headers": ["Content-Type", "X-Auth", "Idempotency-Key"], "expose_headers": ["Location", "ETag"], "credentials": true, "max_age": 600}}
 type MyApi struct {
+	ApiRuntime
 	statuses map[string]int
 	users    map[string]*User
 	nextID   uint64
@@ -50,6 +77,10 @@ func NewMyApi() *MyApi {
 		},
 		nextID: 43,
 		mu:     &sync.RWMutex{},
+		ApiRuntime: ApiRuntime{
+			RateLimitStore:   NewMemoryRateLimitStore(),
+			IdempotencyStore: NewMemoryIdempotencyStore(),
+		},
 	}
 }
 
@@ -57,6 +88,8 @@ type ProfileParams struct {
 	Login string `apivalidator:"required"`
 }
 
+// параметры и результаты с cgen: binpack принимаются и отдаются ещё и в application/x-binpack
+// cgen: binpack len=varint
 type CreateParams struct {
 	Login  string `apivalidator:"required,min=10"`
 	Name   string `apivalidator:"paramname=full_name"`
@@ -64,18 +97,28 @@ type CreateParams struct {
 	Age    int    `apivalidator:"min=0,max=128"`
 }
 
+// cgen: binpack len=varint
 type User struct {
-	ID       uint64 `json:"id"`
-	Login    string `json:"login"`
-	FullName string `json:"full_name"`
-	Status   int    `json:"status"`
+	ID       uint64 `json:"id" xml:"id"`
+	Login    string `json:"login" xml:"login"`
+	FullName string `json:"full_name" xml:"full_name"`
+	Status   int    `json:"status" xml:"status"`
 }
 
+// cgen: binpack
 type NewUser struct {
-	ID uint64 `json:"id"`
+	ID    uint64 `json:"id" xml:"id"`
+	login string `cgen:"-"`
 }
 
-// apigen:api {"url": "/user/profile", "auth": false}
+func (nu *NewUser) Headers() http.Header {
+	return http.Header{
+		"Location": {"/user/profile?" + url.Values{"login": {nu.login}}.Encode()},
+	}
+}
+
+// Profile отдаёт профиль пользователя по логину
+// apigen:api {"url": "/user/profile", "auth": false, "rate_limit": "10/s burst=20", "rate_limit_key": "ip", "etag": true, "cache_control": "private, max-age=60", "compress": true}
 func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
 
 	if in.Login == "bad_user" {
@@ -86,13 +129,14 @@ func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error)
 	user, exist := srv.users[in.Login]
 	srv.mu.RUnlock()
 	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Code: "user_not_found", Err: fmt.Errorf("user not exist")}
 	}
 
 	return user, nil
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// Create регистрирует нового пользователя и возвращает его id
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "status": 201, "idempotent": true, "max_body": "64KB"}
 func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
@@ -103,7 +147,7 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 
 	_, exist := srv.users[in.Login]
 	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
+		return nil, ApiError{HTTPStatus: http.StatusConflict, Code: "user_exists", Err: fmt.Errorf("user %s exist", in.Login)}
 	}
 
 	id := srv.nextID
@@ -115,7 +159,7 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 		Status:   srv.statuses[in.Status],
 	}
 
-	return &NewUser{id}, nil
+	return &NewUser{ID: id, login: in.Login}, nil
 }
 
 // 2-я часть
@@ -123,7 +167,9 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 // код, созданный вашим кодогенератором работает с конкретной струткурой, про другие ничего не знает
 // поэтому то что рядом есть ещё походая структура с такими же методами его нисколько не смущает
 
+// apigen:service {"encoders": ["json"]}
 type OtherApi struct {
+	ApiRuntime
 }
 
 func NewOtherApi() *OtherApi {
@@ -138,12 +184,13 @@ type OtherCreateParams struct {
 }
 
 type OtherUser struct {
-	ID       uint64 `json:"id"`
-	Login    string `json:"login"`
-	FullName string `json:"full_name"`
-	Level    int    `json:"level"`
+	ID       uint64 `json:"id" xml:"id"`
+	Login    string `json:"login" xml:"login"`
+	FullName string `json:"full_name" xml:"full_name"`
+	Level    int    `json:"level" xml:"level"`
 }
 
+// Create создаёт игрового персонажа
 // apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
 func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
 	return &OtherUser{
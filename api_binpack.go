@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// binpackMediaType - тело и ответ в формате binpack из example/gen, для структур с // cgen: binpack
+const binpackMediaType = "application/x-binpack"
+
+// binpackEncoder отдаёт результат метода как есть, без обёртки {"error", "response"}:
+// клиент и так знает, какую структуру ждёт; ошибки binpack не кодирует, они уходят в json
+type binpackEncoder struct{}
+
+func (binpackEncoder) MediaTypes() []string {
+	return []string{binpackMediaType}
+}
+
+func (binpackEncoder) Encode(v interface{}) ([]byte, error) {
+	envelope, ok := v.(responseEnvelope)
+	if !ok || envelope.Error != "" {
+		return nil, errors.New("binpack encodes only method results")
+	}
+	message, ok := envelope.Response.(Message)
+	if !ok {
+		return nil, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("result has no binpack format")}
+	}
+	return message.AppendPack(nil)
+}
+
+// isBinpackRequest - параметры пришли телом application/x-binpack, а не формой
+func isBinpackRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == binpackMediaType
+}
+
+// readBinpack читает тело целиком, его размер уже ограничен max_body
+func readBinpack(r *http.Request, params Message) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	if err := params.Unpack(body); err != nil {
+		return bodyError(err)
+	}
+	return nil
+}
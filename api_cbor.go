@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegint = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborFloat32 = 0xfa
+	cborFloat64 = 0xfb
+)
+
+// cborEncoder - CBOR (RFC 8949) без внешних зависимостей, как и msgpack пишет структуры map-ами по json-тегам
+type cborEncoder struct{}
+
+func (cborEncoder) MediaTypes() []string {
+	return []string{"application/cbor"}
+}
+
+func (cborEncoder) Encode(v interface{}) ([]byte, error) {
+	return cborAppend(nil, reflect.ValueOf(v))
+}
+
+func cborAppend(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, cborNull), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, cborNull), nil
+		}
+		return cborAppend(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, cborTrue), nil
+		}
+		return append(buf, cborFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n >= 0 {
+			return cborAppendHead(buf, cborMajorUint, uint64(n)), nil
+		}
+		return cborAppendHead(buf, cborMajorNegint, uint64(-1-n)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cborAppendHead(buf, cborMajorUint, v.Uint()), nil
+	case reflect.Float32:
+		buf = append(buf, cborFloat32)
+		return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		buf = append(buf, cborFloat64)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return cborAppendText(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, cborNull), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = cborAppendHead(buf, cborMajorBytes, uint64(v.Len()))
+			return append(buf, v.Bytes()...), nil
+		}
+		return cborAppendArray(buf, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			buf = cborAppendHead(buf, cborMajorBytes, uint64(len(data)))
+			return append(buf, data...), nil
+		}
+		return cborAppendArray(buf, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, cborNull), nil
+		}
+		buf = cborAppendHead(buf, cborMajorMap, uint64(v.Len()))
+		for _, key := range sortedMapKeys(v) {
+			if key.Kind() != reflect.String && mapKeyString(key) == "" {
+				return nil, fmt.Errorf("cbor: unsupported map key type %s", key.Type())
+			}
+			buf = cborAppendText(buf, mapKeyString(key))
+			var err error
+			if buf, err = cborAppend(buf, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		fields, values := encodableValues(v)
+		buf = cborAppendHead(buf, cborMajorMap, uint64(len(fields)))
+		for i, field := range fields {
+			buf = cborAppendText(buf, field.name)
+			var err error
+			if buf, err = cborAppend(buf, values[i]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("cbor: unsupported type %s", v.Type())
+}
+
+// cborAppendHead - начальный байт с major type и аргумент минимальной длины
+func cborAppendHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+}
+
+func cborAppendText(buf []byte, s string) []byte {
+	buf = cborAppendHead(buf, cborMajorText, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func cborAppendArray(buf []byte, v reflect.Value) ([]byte, error) {
+	buf = cborAppendHead(buf, cborMajorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if buf, err = cborAppend(buf, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
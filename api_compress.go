@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultCompressMinSize - ответы меньше этого размера не сжимаются, выигрыш не окупает заголовки
+const DefaultCompressMinSize = 1024
+
+func (ar *ApiRuntime) compressMinSize() int {
+	if ar.CompressMinSize > 0 {
+		return ar.CompressMinSize
+	}
+	if GlobalRuntime.CompressMinSize > 0 {
+		return GlobalRuntime.CompressMinSize
+	}
+	return DefaultCompressMinSize
+}
+
+// decompressRequest подменяет тело запроса с Content-Encoding gzip или deflate на распакованное,
+// false означает, что ответ уже отправлен
+func decompressRequest(ep *apiEndpoint, rw http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || r.Body == nil {
+		return true
+	}
+
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(r.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(r.Body)
+	default:
+		responseError(rw, r, ep.Service, ApiError{HTTPStatus: http.StatusUnsupportedMediaType, Code: "unsupported_encoding", Err: errors.New("unsupported content encoding")})
+		return false
+	}
+	if err != nil {
+		responseError(rw, r, ep.Service, bodyError(err))
+		return false
+	}
+
+	r.Body = reader
+	// размер распакованного тела заранее неизвестен, max_body проверится при чтении
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return true
+}
+
+// compress сжимает ответы методов с "compress": true, если клиент это умеет и ответ не меньше порога
+func compress(rt *ApiRuntime, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		buffer := &bufferedWriter{ResponseWriter: rw}
+		next.ServeHTTP(buffer, r)
+		if buffer.status == 0 {
+			buffer.status = http.StatusOK
+		}
+
+		if buffer.body.Len() < rt.compressMinSize() || rw.Header().Get("Content-Encoding") != "" {
+			buffer.flush()
+			return
+		}
+
+		compressed := bytes.Buffer{}
+		var writer io.WriteCloser
+		if encoding == "gzip" {
+			writer = gzip.NewWriter(&compressed)
+		} else {
+			writer = zlib.NewWriter(&compressed)
+		}
+		writer.Write(buffer.body.Bytes())
+		writer.Close()
+
+		rw.Header().Set("Content-Encoding", encoding)
+		rw.Header().Del("Content-Length")
+		// сжатое тело побайтно другое, поэтому ETag становится слабым
+		if etag := rw.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			rw.Header().Set("ETag", "W/"+etag)
+		}
+		buffer.body = compressed
+		buffer.flush()
+	})
+}
+
+// negotiateEncoding выбирает gzip или deflate по Accept-Encoding, при равных q предпочитается gzip
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+	ranges := parseAccept(header)
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q := -1.0
+		for _, accepted := range ranges {
+			if accepted.mediaType == encoding {
+				q = accepted.q
+				break
+			}
+			if accepted.mediaType == "*" {
+				q = accepted.q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// conditional добавляет к успешным GET и HEAD ответам ETag и Cache-Control из apigen:api
+// и отвечает 304, если у клиента уже есть та же версия ответа.
+// ETag берётся из Version() результата, а если его нет - считается по закодированному телу
+func conditional(ep *apiEndpoint, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		buffer := &bufferedWriter{ResponseWriter: rw}
+		next.ServeHTTP(buffer, r)
+		if buffer.status == 0 {
+			buffer.status = http.StatusOK
+		}
+
+		if buffer.status < 200 || buffer.status >= 300 {
+			buffer.flush()
+			return
+		}
+
+		if ep.CacheControl != "" {
+			rw.Header().Set("Cache-Control", ep.CacheControl)
+		}
+		if !ep.ETag {
+			buffer.flush()
+			return
+		}
+
+		etag := rw.Header().Get("ETag")
+		if etag == "" {
+			sum := sha256.Sum256(buffer.body.Bytes())
+			etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+			rw.Header().Set("ETag", etag)
+		}
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			rw.Header().Del("Content-Type")
+			rw.Header().Del("Content-Length")
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		buffer.flush()
+	})
+}
+
+// etagMatch - слабое сравнение из RFC 9110 для If-None-Match
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter придерживает ответ, пока не станет ясно, нужно ли тело
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (bw *bufferedWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *bufferedWriter) Write(data []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw.body.Write(data)
+}
+
+func (bw *bufferedWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+func (bw *bufferedWriter) flush() {
+	bw.ResponseWriter.WriteHeader(bw.status)
+	bw.ResponseWriter.Write(bw.body.Bytes())
+}
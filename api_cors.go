@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsConfig - настройки CORS из "cors" в apigen:service
+type corsConfig struct {
+	// Origins - разрешённые источники, "*" - любой
+	Origins []string
+	// Methods - методы для эндпоинтов без "method" в apigen:api, по умолчанию GET, HEAD и POST
+	Methods       []string
+	Headers       []string
+	ExposeHeaders []string
+	Credentials   bool
+	// MaxAge - сколько секунд браузер может помнить ответ на preflight
+	MaxAge int
+}
+
+var corsDefaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// applyCORS ставит заголовки Access-Control-* на ответ и сам отвечает на preflight,
+// true означает, что запрос обработан и дальше его передавать не нужно
+func applyCORS(ep *apiEndpoint, rw http.ResponseWriter, r *http.Request) bool {
+	cors := ep.Service.CORS
+	if cors == nil {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	requestMethod := r.Header.Get("Access-Control-Request-Method")
+	preflight := r.Method == http.MethodOptions && requestMethod != ""
+
+	rw.Header().Add("Vary", "Origin")
+	if preflight {
+		rw.Header().Add("Vary", "Access-Control-Request-Method")
+		rw.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	allowOrigin, ok := cors.allowOrigin(origin)
+	if !ok {
+		// без Access-Control-Allow-Origin браузер сам не отдаст ответ странице
+		if preflight {
+			rw.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	if cors.Credentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(cors.ExposeHeaders) > 0 {
+			rw.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposeHeaders, ", "))
+		}
+		return false
+	}
+
+	methods := ep.corsMethods()
+	if !containsFold(methods, requestMethod) {
+		rw.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if header = strings.TrimSpace(header); header != "" && !containsFold(cors.Headers, header) {
+			rw.WriteHeader(http.StatusNoContent)
+			return true
+		}
+	}
+
+	rw.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(cors.Headers) > 0 {
+		rw.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+	}
+	if cors.MaxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// allowOrigin - значение для Access-Control-Allow-Origin, с credentials "*" заменяется на сам источник
+func (cors *corsConfig) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, allowed := range cors.Origins {
+		if allowed == "*" {
+			if cors.Credentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// corsMethods - методы из "method" в apigen:api, для метода без ограничений - из настроек CORS
+func (ep *apiEndpoint) corsMethods() []string {
+	if len(ep.Methods) > 0 {
+		return ep.Methods
+	}
+	if len(ep.Service.CORS.Methods) > 0 {
+		return ep.Service.CORS.Methods
+	}
+	return corsDefaultMethods
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
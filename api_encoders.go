@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const jsonMediaType = "application/json"
+
+// Encoder кодирует ответ сгенерированного обработчика в один из форматов
+type Encoder interface {
+	// MediaTypes - типы из Accept, на которые отвечает кодировщик, первый из них основной
+	MediaTypes() []string
+	Encode(v interface{}) ([]byte, error)
+}
+
+var (
+	encodersMu sync.RWMutex
+	// порядок регистрации важен - при равных q и без Accept побеждает первый, то есть json
+	encodersOrder = []string{"json", "xml", "msgpack", "cbor", "binpack"}
+	encoders      = map[string]Encoder{
+		"json":    jsonEncoder{},
+		"xml":     xmlEncoder{},
+		"msgpack": msgpackEncoder{},
+		"cbor":    cborEncoder{},
+		"binpack": binpackEncoder{},
+	}
+)
+
+// RegisterEncoder добавляет или заменяет кодировщик, имя используется в "encoders" из apigen:service
+func RegisterEncoder(name string, encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	if _, exist := encoders[name]; !exist {
+		encodersOrder = append(encodersOrder, name)
+	}
+	encoders[name] = encoder
+}
+
+// responseEnvelope - обёртка {"error": "", "response": ...}, структура нужна ради xml, который не умеет в map
+type responseEnvelope struct {
+	XMLName  xml.Name    `json:"-" xml:"result"`
+	Error    string      `json:"error" xml:"error"`
+	Response interface{} `json:"response,omitempty" xml:"response,omitempty"`
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) MediaTypes() []string {
+	return []string{jsonMediaType}
+}
+
+func (jsonEncoder) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type xmlEncoder struct{}
+
+func (xmlEncoder) MediaTypes() []string {
+	return []string{"application/xml", "text/xml"}
+}
+
+func (xmlEncoder) Encode(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+// negotiate выбирает кодировщик сервиса по заголовку Accept,
+// ok == false означает, что ни один из форматов клиенту не подходит
+func (svc *apiService) negotiate(r *http.Request) (encoder Encoder, mediaType string, ok bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+
+	names := svc.Encoders
+	if len(names) == 0 {
+		names = encodersOrder
+	}
+
+	accept := parseAccept(r.Header.Get("Accept"))
+	if len(accept) == 0 {
+		for _, name := range names {
+			if encoder, exist := encoders[name]; exist {
+				return encoder, encoder.MediaTypes()[0], true
+			}
+		}
+		return nil, "", false
+	}
+
+	bestQ := 0.0
+	for _, name := range names {
+		candidate, exist := encoders[name]
+		if !exist {
+			continue
+		}
+		for _, candidateType := range candidate.MediaTypes() {
+			q, exact := accept.quality(candidateType)
+			if q <= bestQ {
+				continue
+			}
+			bestQ = q
+			encoder = candidate
+			mediaType = candidate.MediaTypes()[0]
+			if exact {
+				mediaType = candidateType
+			}
+		}
+	}
+	return encoder, mediaType, encoder != nil
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+type acceptRanges []acceptRange
+
+func parseAccept(header string) acceptRanges {
+	ranges := acceptRanges{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// quality - q самого точного диапазона, под который подходит mediaType: type/subtype, потом type/*, потом */*
+func (ar acceptRanges) quality(mediaType string) (q float64, exact bool) {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	specificity := -1
+
+	for _, accepted := range ar {
+		current := -1
+		switch accepted.mediaType {
+		case mediaType:
+			current = 2
+		case mainType + "/*":
+			current = 1
+		case "*/*":
+			current = 0
+		}
+		if current > specificity {
+			specificity = current
+			q = accepted.q
+		}
+	}
+	return q, specificity == 2
+}
+
+// encodableField - поле структуры так, как его видит encoding/json: имя из тега, "-" и omitempty
+type encodableField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var encodableFieldsCache sync.Map
+
+// encodableFields нужен бинарным кодировщикам, чтобы ключи совпадали с json
+func encodableFields(t reflect.Type) []encodableField {
+	if cached, ok := encodableFieldsCache.Load(t); ok {
+		return cached.([]encodableField)
+	}
+
+	fields := make([]encodableField, 0, t.NumField())
+	seen := map[string]bool{}
+	collectEncodableFields(t, nil, &fields, seen)
+
+	encodableFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectEncodableFields(t reflect.Type, index []int, fields *[]encodableField, seen map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectEncodableFields(embedded, fieldIndex, fields, seen)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		*fields = append(*fields, encodableField{
+			name:      name,
+			index:     fieldIndex,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+}
+
+// encodableValues - значения полей для записи, с учётом omitempty и nil во встроенных указателях
+func encodableValues(v reflect.Value) ([]encodableField, []reflect.Value) {
+	fields := encodableFields(v.Type())
+	resultFields := make([]encodableField, 0, len(fields))
+	values := make([]reflect.Value, 0, len(fields))
+
+	for _, field := range fields {
+		value, err := v.FieldByIndexErr(field.index)
+		if err != nil {
+			continue
+		}
+		if field.omitEmpty && isEmptyValue(value) {
+			continue
+		}
+		resultFields = append(resultFields, field)
+		values = append(values, value)
+	}
+	return resultFields, values
+}
+
+// isEmptyValue - то же понятие пустоты, что у omitempty в encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// sortedMapKeys - ключи map в стабильном порядке, чтобы ответы можно было сравнивать побайтно
+func sortedMapKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return mapKeyString(keys[i]) < mapKeyString(keys[j])
+	})
+	return keys
+}
+
+func mapKeyString(key reflect.Value) string {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10)
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// общие ошибки для доменного кода: их можно оборачивать через %w,
+// статус ответа подберётся по таблице, импортировать net/http не нужно
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrConflict        = errors.New("conflict")
+	ErrForbidden       = errors.New("forbidden")
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+type errorStatus struct {
+	target error
+	status int
+	code   string
+}
+
+var (
+	errorStatusesMu sync.RWMutex
+	errorStatuses   = []errorStatus{
+		{target: ErrNotFound, status: http.StatusNotFound, code: "not_found"},
+		{target: ErrConflict, status: http.StatusConflict, code: "conflict"},
+		{target: ErrForbidden, status: http.StatusForbidden, code: "forbidden"},
+		{target: ErrInvalidArgument, status: http.StatusBadRequest, code: "invalid_argument"},
+	}
+)
+
+// RegisterErrorStatus связывает ошибку-метку со статусом ответа и кодом для problem+json,
+// повторная регистрация той же ошибки заменяет прежнюю запись
+func RegisterErrorStatus(target error, status int, code string) {
+	errorStatusesMu.Lock()
+	defer errorStatusesMu.Unlock()
+
+	for i := range errorStatuses {
+		if errorStatuses[i].target == target {
+			errorStatuses[i] = errorStatus{target: target, status: status, code: code}
+			return
+		}
+	}
+	errorStatuses = append(errorStatuses, errorStatus{target: target, status: status, code: code})
+}
+
+// asApiError приводит любую ошибку метода к ApiError: сначала ищет ApiError или *ApiError в цепочке,
+// потом ошибки-метки из таблицы, всё остальное - 500. Текст остаётся от исходной ошибки целиком
+func asApiError(err error) ApiError {
+	var apiErr ApiError
+	if errors.As(err, &apiErr) {
+		return ApiError{HTTPStatus: apiErr.HTTPStatus, Code: apiErr.Code, Err: err}
+	}
+
+	var apiErrPtr *ApiError
+	if errors.As(err, &apiErrPtr) && apiErrPtr != nil {
+		return ApiError{HTTPStatus: apiErrPtr.HTTPStatus, Code: apiErrPtr.Code, Err: err}
+	}
+
+	errorStatusesMu.RLock()
+	defer errorStatusesMu.RUnlock()
+
+	for _, mapping := range errorStatuses {
+		if errors.Is(err, mapping.target) {
+			return ApiError{HTTPStatus: mapping.status, Code: mapping.code, Err: err}
+		}
+	}
+
+	return ApiError{HTTPStatus: http.StatusInternalServerError, Code: "internal", Err: err}
+}
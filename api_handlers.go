@@ -1,161 +1,258 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 )
 
+var myApiService = &apiService{
+	Name: "MyApi",
+	CORS: &corsConfig{
+		Origins: []string{"https://app.example.com"},
+		Headers: []string{"Content-Type", "X-Auth", "Idempotency-Key"},
+		ExposeHeaders: []string{"Location", "ETag"},
+		Credentials: true,
+		MaxAge: 600,
+	},
+}
+
+var otherApiService = &apiService{
+	Name: "OtherApi",
+	Encoders: []string{"json"},
+}
+
+var myApiProfileEndpoint = &apiEndpoint{
+	Service: myApiService,
+	Name: "Profile",
+	Url: "/user/profile",
+	RateLimit: &rateLimit{Rate: 10, Burst: 20, Key: "ip"},
+	ETag: true,
+	CacheControl: "private, max-age=60",
+	MaxBody: 1048576, // 1MB
+	ReadTimeout: 10000000000, // 10s
+	Compress: true,
+}
+
+var myApiCreateEndpoint = &apiEndpoint{
+	Service: myApiService,
+	Name: "Create",
+	Url: "/user/create",
+	Methods: []string{"POST"},
+	Idempotent: true,
+	MaxBody: 65536, // 64KB
+	ReadTimeout: 10000000000, // 10s
+}
+
+var otherApiCreateEndpoint = &apiEndpoint{
+	Service: otherApiService,
+	Name: "Create",
+	Url: "/user/create",
+	Methods: []string{"POST"},
+	MaxBody: 1048576, // 1MB
+	ReadTimeout: 10000000000, // 10s
+}
+
 func (m *MyApi) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/user/profile":
-		m.profile(rw, r)
+		serveEndpoint(runtimeOf(m), myApiProfileEndpoint, http.HandlerFunc(m.profile), rw, r)
 	case "/user/create":
-		m.create(rw, r)
+		serveEndpoint(runtimeOf(m), myApiCreateEndpoint, http.HandlerFunc(m.create), rw, r)
 	default:
-		responseError(rw, ApiError{HTTPStatus:http.StatusNotFound,Err: errors.New("unknown method")})
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusNotFound, Code: "unknown_method", Err: errors.New("unknown method")})
 	}
 }
 
 func (o *OtherApi) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/user/create":
-		o.create(rw, r)
+		serveEndpoint(runtimeOf(o), otherApiCreateEndpoint, http.HandlerFunc(o.create), rw, r)
 	default:
-		responseError(rw, ApiError{HTTPStatus:http.StatusNotFound,Err: errors.New("unknown method")})
+		responseError(rw, r, otherApiService, ApiError{HTTPStatus: http.StatusNotFound, Code: "unknown_method", Err: errors.New("unknown method")})
 	}
 }
 
 func (m *MyApi) profile(rw http.ResponseWriter, r *http.Request) {
+	if !allowRequest(runtimeOf(m), myApiProfileEndpoint, rw, r, true) {
+		return
+	}
+	if _, _, ok := myApiService.negotiate(r); !ok {
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("not acceptable")})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		responseError(rw, r, myApiService, bodyError(err))
+		return
+	}
 	profileparams := ProfileParams{}
 	if err := profileparams.FilingAndValidate(r); err != nil {
-		responseError(rw, ApiError{HTTPStatus: http.StatusBadRequest,Err:err})
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusBadRequest, Code: "invalid_param", Err: err})
 		return
 	}
 	response, err := m.Profile(nil, profileparams)
 	if err != nil {
-		apiErr, ok := err.(ApiError)
-		if ok {
-			responseError(rw, apiErr)
-			return
-		}
-		responseError(rw, ApiError{HTTPStatus: http.StatusInternalServerError, Err:err})
+		responseError(rw, r, myApiService, asApiError(err))
 		return
 	}
-	responseResult(rw, err, response)
+	responseResult(rw, r, myApiService, 200, response)
 }
 
 func (m *MyApi) create(rw http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-Auth") != "100500" {
-		responseError(rw, ApiError{HTTPStatus: http.StatusForbidden, Err: errors.New("unauthorized")})
+	authorized := r.Header.Get("X-Auth") == "100500"
+	if authorized {
+		setPrincipal(r, runtimeOf(m).principal(r))
+	}
+	if !allowRequest(runtimeOf(m), myApiCreateEndpoint, rw, r, true) {
+		return
+	}
+	if !authorized {
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusForbidden, Code: "unauthorized", Err: errors.New("unauthorized")})
 		return
 	}
 	if r.Method != "POST" {
-		responseError(rw, ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New("bad method")})
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "bad_method", Err: errors.New("bad method")})
+		return
+	}
+	if _, _, ok := myApiService.negotiate(r); !ok {
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("not acceptable")})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		responseError(rw, r, myApiService, bodyError(err))
 		return
 	}
 	createparams := CreateParams{}
-	if err := createparams.FilingAndValidate(r); err != nil {
-		responseError(rw, ApiError{HTTPStatus: http.StatusBadRequest,Err:err})
+	if isBinpackRequest(r) {
+		if err := readBinpack(r, &createparams); err != nil {
+			responseError(rw, r, myApiService, err)
+			return
+		}
+		if err := createparams.Validate(); err != nil {
+			responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusBadRequest, Code: "invalid_param", Err: err})
+			return
+		}
+	} else if err := createparams.FilingAndValidate(r); err != nil {
+		responseError(rw, r, myApiService, ApiError{HTTPStatus: http.StatusBadRequest, Code: "invalid_param", Err: err})
 		return
 	}
 	response, err := m.Create(nil, createparams)
 	if err != nil {
-		apiErr, ok := err.(ApiError)
-		if ok {
-			responseError(rw, apiErr)
-			return
-		}
-		responseError(rw, ApiError{HTTPStatus: http.StatusInternalServerError, Err:err})
+		responseError(rw, r, myApiService, asApiError(err))
 		return
 	}
-	responseResult(rw, err, response)
+	responseResult(rw, r, myApiService, 201, response)
 }
 
 func (o *OtherApi) create(rw http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-Auth") != "100500" {
-		responseError(rw, ApiError{HTTPStatus: http.StatusForbidden, Err: errors.New("unauthorized")})
+	authorized := r.Header.Get("X-Auth") == "100500"
+	if authorized {
+		setPrincipal(r, runtimeOf(o).principal(r))
+	}
+	if !allowRequest(runtimeOf(o), otherApiCreateEndpoint, rw, r, true) {
+		return
+	}
+	if !authorized {
+		responseError(rw, r, otherApiService, ApiError{HTTPStatus: http.StatusForbidden, Code: "unauthorized", Err: errors.New("unauthorized")})
 		return
 	}
 	if r.Method != "POST" {
-		responseError(rw, ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New("bad method")})
+		responseError(rw, r, otherApiService, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "bad_method", Err: errors.New("bad method")})
+		return
+	}
+	if _, mediaType, ok := otherApiService.negotiate(r); !ok || mediaType == binpackMediaType {
+		responseError(rw, r, otherApiService, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("not acceptable")})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		responseError(rw, r, otherApiService, bodyError(err))
 		return
 	}
 	othercreateparams := OtherCreateParams{}
 	if err := othercreateparams.FilingAndValidate(r); err != nil {
-		responseError(rw, ApiError{HTTPStatus: http.StatusBadRequest,Err:err})
+		responseError(rw, r, otherApiService, ApiError{HTTPStatus: http.StatusBadRequest, Code: "invalid_param", Err: err})
 		return
 	}
 	response, err := o.Create(nil, othercreateparams)
 	if err != nil {
-		apiErr, ok := err.(ApiError)
-		if ok {
-			responseError(rw, apiErr)
-			return
-		}
-		responseError(rw, ApiError{HTTPStatus: http.StatusInternalServerError, Err:err})
+		responseError(rw, r, otherApiService, asApiError(err))
 		return
 	}
-	responseResult(rw, err, response)
+	responseResult(rw, r, otherApiService, 200, response)
 }
 
-func responseError(rw http.ResponseWriter, err error) {
+func responseError(rw http.ResponseWriter, r *http.Request, svc *apiService, err error) {
 	if err == nil {
 		return
 	}
+	recordError(r, err)
 
-	type CR map[string]interface{}
+	if svc.ErrorFormat == errorFormatProblem {
+		responseProblem(rw, r, svc, err)
+		return
+	}
 
-	apiErr, ok := err.(ApiError)
-	if ok {
-		rw.WriteHeader(apiErr.HTTPStatus)
+	encoder, mediaType, ok := svc.negotiate(r)
+	if !ok {
+		encoder, mediaType = jsonEncoder{}, jsonMediaType
 	}
-	responseMap := CR{"error": err.Error()}
-	response, _ := json.Marshal(responseMap)
+	response, encodeErr := encoder.Encode(responseEnvelope{Error: err.Error()})
+	if encodeErr != nil {
+		// не каждый формат умеет ошибки, binpack например кодирует только сами результаты
+		response, _ = jsonEncoder{}.Encode(responseEnvelope{Error: err.Error()})
+		mediaType = jsonMediaType
+	}
+	rw.Header().Set("Content-Type", mediaType)
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(asApiError(err).HTTPStatus)
 	rw.Write(response)
 }
 
-func responseResult(rw http.ResponseWriter, err error, result interface{}) {
-	type CR map[string]interface{}
-	textErr := ""
-
+func responseResult(rw http.ResponseWriter, r *http.Request, svc *apiService, status int, result interface{}) {
+	encoder, mediaType, ok := svc.negotiate(r)
+	if !ok {
+		responseError(rw, r, svc, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("not acceptable")})
+		return
+	}
+	response, err := encoder.Encode(responseEnvelope{Response: result})
 	if err != nil {
-		textErr = err.Error()
+		var apiErr ApiError
+		if !errors.As(err, &apiErr) {
+			apiErr = ApiError{HTTPStatus: http.StatusInternalServerError, Code: "internal", Err: err}
+		}
+		responseError(rw, r, svc, apiErr)
+		return
 	}
 
-	responseMap := CR{
-		"error":    textErr,
-		"response": result,
+	if withHeaders, ok := result.(ResultHeaders); ok {
+		for key, values := range withHeaders.Headers() {
+			for _, value := range values {
+				rw.Header().Add(key, value)
+			}
+		}
 	}
-
-	response, err := json.Marshal(responseMap)
-	if err != nil {
-		fmt.Println(err)
+	if withStatus, ok := result.(ResultStatus); ok && withStatus.StatusCode() != 0 {
+		status = withStatus.StatusCode()
+	}
+	if withVersion, ok := result.(ResultVersion); ok && withVersion.Version() != "" {
+		rw.Header().Set("ETag", "\""+withVersion.Version()+"\"")
 	}
-	rw.Write(response)
-}
 
-func (p *ProfileParams) FilingAndValidate(r *http.Request) error {
-	var err error
-	fmt.Println(err)
-p.Login = r.FormValue("login")
-if p.Login == ""{
-return errors.New("login must me not empty")
-}
-	return nil
+	rw.Header().Set("Content-Type", mediaType)
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(status)
+	rw.Write(response)
 }
 
 func (c *CreateParams) FilingAndValidate(r *http.Request) error {
 	var err error
-	fmt.Println(err)
+	_ = err
 c.Login = r.FormValue("login")
 if c.Login == ""{
-return errors.New("login must me not empty")
+return ParamError{Param: "login", Err: errors.New("login must me not empty")}
 }
 if len(c.Login) < 10{
-return errors.New("login len must be >= 10")
+return ParamError{Param: "login", Err: errors.New("login len must be >= 10")}
 }
 c.Name = r.FormValue("name")
 c.Name = r.FormValue("full_name")
@@ -174,30 +271,62 @@ if c.Status == "admin"{
 isTrue=true
 }
 if !isTrue{
-return errors.New("status must be one of [user, moderator, admin]")
+return ParamError{Param: "status", Err: errors.New("status must be one of [user, moderator, admin]")}
 }
 c.Age,err = strconv.Atoi(r.FormValue("age"))
 if err != nil{
-return errors.New("age must be int")
+return ParamError{Param: "age", Err: errors.New("age must be int")}
 }
 if c.Age < 0{
-return errors.New("age must be >= 0")
+return ParamError{Param: "age", Err: errors.New("age must be >= 0")}
 }
 if c.Age > 128{
-return errors.New("age must be <= 128")
+return ParamError{Param: "age", Err: errors.New("age must be <= 128")}
+}
+	return nil
+}
+
+func (c *CreateParams) Validate() error {
+if c.Login == ""{
+return ParamError{Param: "login", Err: errors.New("login must me not empty")}
+}
+if len(c.Login) < 10{
+return ParamError{Param: "login", Err: errors.New("login len must be >= 10")}
+}
+if c.Status == ""{
+c.Status = "user"
+}
+isTrue:=false
+if c.Status == "user"{
+isTrue=true
+}
+if c.Status == "moderator"{
+isTrue=true
+}
+if c.Status == "admin"{
+isTrue=true
+}
+if !isTrue{
+return ParamError{Param: "status", Err: errors.New("status must be one of [user, moderator, admin]")}
+}
+if c.Age < 0{
+return ParamError{Param: "age", Err: errors.New("age must be >= 0")}
+}
+if c.Age > 128{
+return ParamError{Param: "age", Err: errors.New("age must be <= 128")}
 }
 	return nil
 }
 
 func (o *OtherCreateParams) FilingAndValidate(r *http.Request) error {
 	var err error
-	fmt.Println(err)
+	_ = err
 o.Username = r.FormValue("username")
 if o.Username == ""{
-return errors.New("username must me not empty")
+return ParamError{Param: "username", Err: errors.New("username must me not empty")}
 }
 if len(o.Username) < 3{
-return errors.New("username len must be >= 3")
+return ParamError{Param: "username", Err: errors.New("username len must be >= 3")}
 }
 o.Name = r.FormValue("name")
 o.Name = r.FormValue("account_name")
@@ -213,20 +342,30 @@ if o.Class == "rouge"{
 isTrue=true
 }
 if !isTrue{
-return errors.New("class must be one of [warrior, sorcerer, rouge]")
+return ParamError{Param: "class", Err: errors.New("class must be one of [warrior, sorcerer, rouge]")}
 }
 if o.Class == ""{
 o.Class = "warrior"
 }
 o.Level,err = strconv.Atoi(r.FormValue("level"))
 if err != nil{
-return errors.New("age must be int")
+return ParamError{Param: "level", Err: errors.New("level must be int")}
 }
 if o.Level < 1{
-return errors.New("level must be >= 1")
+return ParamError{Param: "level", Err: errors.New("level must be >= 1")}
 }
 if o.Level > 50{
-return errors.New("level must be <= 50")
+return ParamError{Param: "level", Err: errors.New("level must be <= 50")}
+}
+	return nil
+}
+
+func (p *ProfileParams) FilingAndValidate(r *http.Request) error {
+	var err error
+	_ = err
+p.Login = r.FormValue("login")
+if p.Login == ""{
+return ParamError{Param: "login", Err: errors.New("login must me not empty")}
 }
 	return nil
 }
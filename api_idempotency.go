@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// DefaultIdempotencyTTL - сколько хранить ответ, если в ApiRuntime не задано другое
+	DefaultIdempotencyTTL = 24 * time.Hour
+)
+
+// IdempotentResponse - сохранённый ответ, который отдаётся повторно на запрос с тем же ключом
+type IdempotentResponse struct {
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore хранит ответы методов с "idempotent": true
+type IdempotencyStore interface {
+	// Reserve атомарно занимает ключ. Если ключ уже занят, reserved == false,
+	// а saved - сохранённый ответ или nil, пока первый запрос ещё выполняется
+	Reserve(key, fingerprint string, ttl time.Duration) (saved *IdempotentResponse, reserved bool)
+	Save(key string, response *IdempotentResponse, ttl time.Duration)
+	// Release освобождает ключ, если ответ сохранять не нужно
+	Release(key string)
+}
+
+// MemoryIdempotencyStore - хранилище в памяти процесса
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *IdempotentResponse
+	expires     time.Time
+}
+
+var defaultIdempotencyStore = NewMemoryIdempotencyStore()
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: map[string]*idempotencyEntry{},
+		now:     time.Now,
+	}
+}
+
+func (ms *MemoryIdempotencyStore) Reserve(key, fingerprint string, ttl time.Duration) (*IdempotentResponse, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+
+	if entry, exist := ms.entries[key]; exist && now.Before(entry.expires) {
+		if entry.response == nil && entry.fingerprint != fingerprint {
+			return &IdempotentResponse{Fingerprint: entry.fingerprint}, false
+		}
+		return entry.response, false
+	}
+
+	ms.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(ttl)}
+	return nil, true
+}
+
+func (ms *MemoryIdempotencyStore) Save(key string, response *IdempotentResponse, ttl time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.entries[key] = &idempotencyEntry{
+		fingerprint: response.Fingerprint,
+		response:    response,
+		expires:     ms.now().Add(ttl),
+	}
+}
+
+func (ms *MemoryIdempotencyStore) Release(key string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.entries, key)
+}
+
+func (ms *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < time.Minute {
+		return
+	}
+	ms.lastSweep = now
+
+	for key, entry := range ms.entries {
+		if !now.Before(entry.expires) {
+			delete(ms.entries, key)
+		}
+	}
+}
+
+func (ar *ApiRuntime) idempotencyStore() IdempotencyStore {
+	if ar.IdempotencyStore != nil {
+		return ar.IdempotencyStore
+	}
+	if GlobalRuntime.IdempotencyStore != nil {
+		return GlobalRuntime.IdempotencyStore
+	}
+	return defaultIdempotencyStore
+}
+
+func (ar *ApiRuntime) idempotencyTTL() time.Duration {
+	if ar.IdempotencyTTL > 0 {
+		return ar.IdempotencyTTL
+	}
+	if GlobalRuntime.IdempotencyTTL > 0 {
+		return GlobalRuntime.IdempotencyTTL
+	}
+	return DefaultIdempotencyTTL
+}
+
+// idempotent оборачивает метод с "idempotent": true: ответ на запрос с Idempotency-Key запоминается
+// и отдаётся повторно, пока не истечёт TTL. Ключ действует в пределах метода и того, кто его вызывает
+func idempotent(rt *ApiRuntime, ep *apiEndpoint, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+		if idempotencyKey == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			responseError(rw, r, ep.Service, bodyError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := ep.Service.Name + " " + ep.Url + " " + rt.principal(r) + " " + idempotencyKey
+		_, mediaType, _ := ep.Service.negotiate(r)
+		fingerprint := requestFingerprint(r, mediaType, body)
+		store := rt.idempotencyStore()
+		ttl := rt.idempotencyTTL()
+
+		saved, reserved := store.Reserve(key, fingerprint, ttl)
+		switch {
+		case !reserved && saved != nil && saved.Fingerprint != fingerprint:
+			responseError(rw, r, ep.Service, ApiError{HTTPStatus: http.StatusUnprocessableEntity, Code: "idempotency_key_reused", Err: errors.New("idempotency key reused with different request")})
+			return
+		case !reserved && saved == nil:
+			responseError(rw, r, ep.Service, ApiError{HTTPStatus: http.StatusConflict, Code: "idempotency_in_progress", Err: errors.New("request with this idempotency key is in progress")})
+			return
+		case !reserved:
+			for name, values := range saved.Header {
+				rw.Header()[name] = append([]string{}, values...)
+			}
+			rw.Header().Set("Idempotent-Replayed", "true")
+			rw.WriteHeader(saved.Status)
+			rw.Write(saved.Body)
+			return
+		}
+
+		capture := &captureWriter{ResponseWriter: rw}
+		defer func() {
+			if retryableStatus(capture.status) {
+				store.Release(key)
+				return
+			}
+			store.Save(key, &IdempotentResponse{
+				Fingerprint: fingerprint,
+				Status:      capture.status,
+				Header:      capture.header,
+				Body:        capture.body.Bytes(),
+			}, ttl)
+		}()
+		next.ServeHTTP(capture, r)
+		if capture.status == 0 {
+			capture.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// retryableStatus - ответы, после которых повтор должен выполнить метод ещё раз: 5xx и паники,
+// а ещё отказы до вызова метода - авторизация, лимиты, таймаут и размер тела
+func retryableStatus(status int) bool {
+	switch status {
+	case 0, http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout,
+		http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// requestFingerprint - по нему отличаем честный повтор от нового запроса с тем же ключом,
+// mediaType - формат ответа: сохранённое тело в другом формате клиенту не подойдёт
+func requestFingerprint(r *http.Request, mediaType string, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+"\n"+r.URL.Path+"\n"+r.URL.Query().Encode()+"\n"+r.Header.Get("Content-Type")+"\n"+mediaType+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// captureWriter пишет ответ клиенту и одновременно копит его для сохранения
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+		cw.header = cw.ResponseWriter.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(data []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.body.Write(data)
+	return cw.ResponseWriter.Write(data)
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
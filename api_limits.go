@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// limitRequest ограничивает тело запроса по "max_body" и время его чтения по "read_timeout",
+// false означает, что ответ уже отправлен
+func limitRequest(ep *apiEndpoint, rw http.ResponseWriter, r *http.Request) bool {
+	if ep.MaxBody > 0 {
+		if r.ContentLength > ep.MaxBody {
+			responseError(rw, r, ep.Service, bodyError(&http.MaxBytesError{Limit: ep.MaxBody}))
+			return false
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(rw, r.Body, ep.MaxBody)
+		}
+	}
+	if ep.ReadTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+		// не каждый ResponseWriter умеет дедлайны, например httptest.ResponseRecorder - тогда просто без них
+		controller := http.NewResponseController(rw)
+		if controller.SetReadDeadline(time.Now().Add(ep.ReadTimeout)) == nil {
+			r.Body = &deadlineBody{ReadCloser: r.Body, controller: controller}
+		}
+	}
+	return true
+}
+
+// deadlineBody снимает дедлайн, как только тело дочитано: иначе он остался бы на соединении
+// и оборвал бы долгий метод или следующий запрос keep-alive. После ошибки чтения дедлайн остаётся -
+// соединение всё равно закроется, а без него сервер ждал бы недосланный остаток тела вечно
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	done       bool
+}
+
+func (db *deadlineBody) Read(p []byte) (int, error) {
+	n, err := db.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF:
+		db.clear()
+	case err != nil:
+		db.done = true
+	}
+	return n, err
+}
+
+func (db *deadlineBody) Close() error {
+	db.clear()
+	return db.ReadCloser.Close()
+}
+
+func (db *deadlineBody) clear() {
+	if !db.done {
+		db.done = true
+		db.controller.SetReadDeadline(time.Time{})
+	}
+}
+
+// clearReadDeadline - для тела, которое метод так и не дочитал
+func clearReadDeadline(r *http.Request) {
+	if body, ok := r.Body.(*deadlineBody); ok {
+		body.clear()
+	}
+}
+
+// bodyError - ошибка чтения тела запроса в виде ответа клиенту
+func bodyError(err error) ApiError {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ApiError{HTTPStatus: http.StatusRequestEntityTooLarge, Code: "body_too_large", Err: errors.New("request body too large")}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ApiError{HTTPStatus: http.StatusRequestTimeout, Code: "request_timeout", Err: errors.New("request body read timeout")}
+	}
+	return ApiError{HTTPStatus: http.StatusBadRequest, Code: "bad_body", Err: err}
+}
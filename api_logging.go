@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo - то, что сгенерированный обработчик узнаёт по ходу запроса и что нужно журналу
+type requestInfo struct {
+	Principal string
+	Err       error
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// PrincipalFrom - кто выполняет запрос, пусто для методов без авторизации
+func PrincipalFrom(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.Principal
+	}
+	return ""
+}
+
+func setPrincipal(r *http.Request, principal string) {
+	if info := requestInfoFrom(r); info != nil {
+		info.Principal = principal
+	}
+}
+
+func recordError(r *http.Request, err error) {
+	if info := requestInfoFrom(r); info != nil {
+		info.Err = err
+	}
+}
+
+func (ar *ApiRuntime) logger() *slog.Logger {
+	if ar.Logger != nil {
+		return ar.Logger
+	}
+	if GlobalRuntime.Logger != nil {
+		return GlobalRuntime.Logger
+	}
+	return slog.Default()
+}
+
+func (ar *ApiRuntime) principal(r *http.Request) string {
+	if ar.Principal != nil {
+		return ar.Principal(r)
+	}
+	if GlobalRuntime.Principal != nil {
+		return GlobalRuntime.Principal(r)
+	}
+	return defaultPrincipal(r)
+}
+
+// defaultPrincipal - сам токен в журнал писать нельзя, поэтому его хэш; хэш целиком,
+// по principal считаются вёдра rate_limit и ключи идемпотентности, разные токены не должны совпадать
+func defaultPrincipal(r *http.Request) string {
+	token := r.Header.Get("X-Auth")
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "x-auth:" + hex.EncodeToString(sum[:])
+}
+
+// logRequest - одна запись журнала на запрос
+func logRequest(rt *ApiRuntime, ep *apiEndpoint, recorder *responseRecorder, r *http.Request, info *requestInfo, latency time.Duration) {
+	status := recorder.statusCode()
+
+	level := slog.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("endpoint", ep.fullName()),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.Duration("latency", latency),
+		slog.Int("size", recorder.size),
+	}
+	if info.Principal != "" {
+		attrs = append(attrs, slog.String("principal", info.Principal))
+	}
+
+	var paramErr ParamError
+	switch {
+	case errors.As(info.Err, &paramErr):
+		attrs = append(attrs, slog.String("validation_error", paramErr.Error()))
+	case info.Err != nil:
+		attrs = append(attrs, slog.String("error", info.Err.Error()))
+	}
+
+	rt.logger().LogAttrs(r.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,687 @@
+package main
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "unsafe"
+
+var (
+	// ErrShortBuffer - данные закончились раньше, чем структура
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrLengthTooLarge - длина строки больше maxlen из тега или больше, чем влезает в префикс длины
+	ErrLengthTooLarge = errors.New("length too large")
+	// ErrOutOfRange - число не помещается в поле бинарного формата
+	ErrOutOfRange = errors.New("value out of range")
+	// ErrBadValue - байт bool не 0 и не 1 или varint длиннее 10 байт
+	ErrBadValue = errors.New("bad value")
+)
+
+// FieldError - ошибка упаковки или распаковки поля, Offset - начало поля в данных
+type FieldError struct {
+	Struct string
+	Field  string
+	Offset int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("binpack: %s.%s at offset %d: %v", e.Struct, e.Field, e.Offset, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// binpackChunk - сколько байт или элементов слайса выделять сразу при чтении из потока
+const binpackChunk = 4096
+
+// binpackReader - источник данных декодера, varint читается по байту
+type binpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// binpackDecoder читает значения по порядку; первая ошибка запоминается, после неё читаются нули.
+// Unpack читает прямо из слайса data, без binary.Read и рефлексии, DecodeFrom - из потока stream
+type binpackDecoder struct {
+	data   []byte
+	stream *binpackStream
+	// end - где кончаются данные или тело версионной структуры, -1 - поток без предела
+	end int
+	// offset - сколько байт data уже прочитано
+	offset int
+	order  binary.ByteOrder
+	// field - начало текущего поля, для FieldError
+	field int
+	err   error
+}
+
+func newBinpackDecoder(data []byte) *binpackDecoder {
+	return &binpackDecoder{data: data, end: len(data), order: binary.LittleEndian}
+}
+
+// newBinpackStreamDecoder читает из потока ровно столько байт, сколько занимает структура,
+// поэтому структуры можно читать из одного потока подряд
+func newBinpackStreamDecoder(r io.Reader) *binpackDecoder {
+	br, ok := r.(binpackReader)
+	if !ok {
+		br = &binpackByteReader{Reader: r}
+	}
+	return &binpackDecoder{stream: &binpackStream{r: br, end: -1}, end: -1, order: binary.LittleEndian}
+}
+
+// binpackStream считает прочитанные из потока байты для смещений в FieldError;
+// он отдельно от декодера, чтобы декодер Unpack не уходил в кучу через интерфейсы io
+type binpackStream struct {
+	r binpackReader
+	n int
+	// end - конец тела версионной структуры, дальше поток читается только через leave
+	end int
+}
+
+func (s *binpackStream) Read(p []byte) (int, error) {
+	if s.end >= 0 {
+		if s.n >= s.end {
+			return 0, io.EOF
+		}
+		if len(p) > s.end-s.n {
+			p = p[:s.end-s.n]
+		}
+	}
+	n, err := s.r.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *binpackStream) ReadByte() (byte, error) {
+	if s.end >= 0 && s.n >= s.end {
+		return 0, io.EOF
+	}
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.n++
+	}
+	return b, err
+}
+
+// binpackByteReader читает по одному байту без буфера, чтобы не забрать из потока лишнего;
+// для скорости в DecodeFrom лучше передать *bufio.Reader
+type binpackByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *binpackByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.Reader, r.b[:])
+	return r.b[0], err
+}
+
+// pos - сколько байт уже прочитано
+func (d *binpackDecoder) pos() int {
+	if d.stream != nil {
+		return d.stream.n
+	}
+	return d.offset
+}
+
+// begin отмечает начало поля; порядок байт ставится заново, потому что вложенная структура могла его поменять
+func (d *binpackDecoder) begin(order binary.ByteOrder) {
+	d.field = d.pos()
+	d.order = order
+}
+
+// streamErr - результат DecodeFrom: если поток кончился до первого байта структуры, это io.EOF, как у binary.Read
+func (d *binpackDecoder) streamErr() error {
+	if d.pos() == 0 && errors.Is(d.err, ErrShortBuffer) {
+		return io.EOF
+	}
+	return d.err
+}
+
+// enter читает заголовок версионной структуры - версию и длину тела - и ограничивает чтение телом;
+// outer - прежний предел, его возвращает leave
+func (d *binpackDecoder) enter() (version uint64, outer int) {
+	version = d.varint()
+	size := d.length(uint64(d.uint32()), 0)
+	outer = d.end
+	if d.err == nil {
+		d.setEnd(d.pos() + size)
+	}
+	return version, outer
+}
+
+// leave пропускает непрочитанный конец тела - поля из более новой версии - и возвращает внешний предел
+func (d *binpackDecoder) leave(outer int) {
+	if d.err == nil && d.pos() < d.end {
+		if d.stream == nil {
+			d.offset = d.end
+		} else {
+			_, d.err = io.CopyN(io.Discard, d.stream, int64(d.end-d.pos()))
+		}
+	}
+	d.setEnd(outer)
+}
+
+func (d *binpackDecoder) setEnd(end int) {
+	d.end = end
+	if d.stream != nil {
+		d.stream.end = end
+	}
+}
+
+// failed заворачивает ошибку в FieldError, ошибки вложенных структур уже завёрнуты
+func (d *binpackDecoder) failed(structName, field string) bool {
+	if d.err == nil {
+		return false
+	}
+	var fieldErr *FieldError
+	if !errors.As(d.err, &fieldErr) {
+		if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+			d.err = ErrShortBuffer
+		}
+		d.err = &FieldError{Struct: structName, Field: field, Offset: d.field, Err: d.err}
+	}
+	return true
+}
+
+func (d *binpackDecoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.stream, d.order, v)
+	}
+}
+
+// take отдаёт следующие n байт из data без копирования, nil - данные кончились или уже была ошибка
+func (d *binpackDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > d.end-d.offset {
+		d.err = ErrShortBuffer
+		return nil
+	}
+	v := d.data[d.offset : d.offset+n : d.offset+n]
+	d.offset += n
+	return v
+}
+
+func (d *binpackDecoder) uint8() uint8 {
+	if d.stream == nil {
+		if b := d.take(1); b != nil {
+			return b[0]
+		}
+		return 0
+	}
+	var v uint8
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint16() uint16 {
+	if d.stream == nil {
+		if b := d.take(2); b != nil {
+			return d.order.Uint16(b)
+		}
+		return 0
+	}
+	var v uint16
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint32() uint32 {
+	if d.stream == nil {
+		if b := d.take(4); b != nil {
+			return d.order.Uint32(b)
+		}
+		return 0
+	}
+	var v uint32
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint64() uint64 {
+	if d.stream == nil {
+		if b := d.take(8); b != nil {
+			return d.order.Uint64(b)
+		}
+		return 0
+	}
+	var v uint64
+	d.read(&v)
+	return v
+}
+
+// varint читает LEB128, как в protobuf
+func (d *binpackDecoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if d.stream == nil {
+		v, n := binary.Uvarint(d.data[d.offset:d.end])
+		switch {
+		case n == 0:
+			d.err = ErrShortBuffer
+		case n < 0:
+			d.err = ErrBadValue
+		default:
+			d.offset += n
+		}
+		return v
+	}
+	v, err := binary.ReadUvarint(d.stream)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.err = err
+	case err != nil:
+		d.err = ErrBadValue
+	}
+	return v
+}
+
+// zigzag читает знаковый varint, как sint64 в protobuf, и возвращает его биты
+func (d *binpackDecoder) zigzag() uint64 {
+	v := d.varint()
+	return uint64(int64(v>>1) ^ -int64(v&1))
+}
+
+func (d *binpackDecoder) bool() bool {
+	v := d.uint8()
+	if v > 1 && d.err == nil {
+		d.err = ErrBadValue
+	}
+	return v == 1
+}
+
+func (d *binpackDecoder) float32() float32 {
+	return math.Float32frombits(d.uint32())
+}
+
+func (d *binpackDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// checkUint и checkInt - значение из данных не помещается в тип поля
+func (d *binpackDecoder) checkUint(v, max uint64) uint64 {
+	if v > max && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+func (d *binpackDecoder) checkInt(v, min, max int64) int64 {
+	if (v < min || v > max) && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+// length проверяет прочитанный префикс длины до всякого make,
+// чтобы испорченный префикс не просил гигабайты
+func (d *binpackDecoder) length(n uint64, maxLen int) int {
+	switch {
+	case d.err != nil:
+		return 0
+	case maxLen > 0 && n > uint64(maxLen):
+		d.err = ErrLengthTooLarge
+		return 0
+	case d.end >= 0 && n > uint64(d.end-d.pos()):
+		d.err = ErrShortBuffer
+		return 0
+	case n > math.MaxInt32:
+		// столько в память всё равно не поместить
+		d.err = ErrLengthTooLarge
+		return 0
+	}
+	return int(n)
+}
+
+// capacity - сколько элементов слайса выделить сразу; в потоке длину нечем проверить
+// (длина тела версионной структуры тоже только заявлена), поэтому слайс растёт по мере чтения
+func (d *binpackDecoder) capacity(n int) int {
+	if d.stream != nil && n > binpackChunk {
+		return binpackChunk
+	}
+	return n
+}
+
+func (d *binpackDecoder) bytes(n int) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if d.stream == nil {
+		return append([]byte(nil), d.take(n)...)
+	}
+	if d.stream != nil && n > binpackChunk {
+		buf := bytes.Buffer{}
+		buf.Grow(binpackChunk)
+		_, d.err = io.CopyN(&buf, d.stream, int64(n))
+		return buf.Bytes()
+	}
+	v := make([]byte, n)
+	_, d.err = io.ReadFull(d.stream, v)
+	return v
+}
+
+// string копирует байты строки один раз, без промежуточного []byte
+func (d *binpackDecoder) string(n int) string {
+	if d.stream == nil {
+		return string(d.take(n))
+	}
+	return string(d.bytes(n))
+}
+
+// alias и aliasString для cgen:"noalloc" ссылаются на данные Unpack без копирования,
+// такие поля живут, пока данные не меняют; из потока ссылаться не на что, там это обычное чтение
+func (d *binpackDecoder) alias(n int) []byte {
+	if d.stream == nil {
+		if n == 0 {
+			return nil
+		}
+		return d.take(n)
+	}
+	return d.bytes(n)
+}
+
+func (d *binpackDecoder) aliasString(n int) string {
+	if d.stream == nil {
+		if b := d.take(n); len(b) > 0 {
+			return unsafe.String(&b[0], len(b))
+		}
+		return ""
+	}
+	return string(d.bytes(n))
+}
+
+func (d *binpackDecoder) fill(v []byte) {
+	switch {
+	case d.stream == nil:
+		copy(v, d.take(len(v)))
+	case d.err == nil:
+		_, d.err = io.ReadFull(d.stream, v)
+	}
+}
+
+func binpackBool(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Message - структура с // cgen: binpack
+type Message interface {
+	Unpack(data []byte) error
+	AppendPack(dst []byte) ([]byte, error)
+}
+
+// DefaultMaxFrameSize - предел длины записи у FrameReader по умолчанию
+const DefaultMaxFrameSize = 16 << 20
+
+// FrameReader читает поток записей с префиксом длины varint, как writeDelimitedTo в protobuf;
+// в памяти держится только текущая запись, поэтому поля cgen:"noalloc" живут до следующего Next
+type FrameReader struct {
+	r *bufio.Reader
+	// MaxSize - предел длины одной записи, чтобы испорченный префикс не просил гигабайты
+	MaxSize int
+	buf     []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), MaxSize: DefaultMaxFrameSize}
+}
+
+// Next читает следующую запись в m, когда записи кончились - возвращает io.EOF
+func (fr *FrameReader) Next(m Message) error {
+	size, err := binary.ReadUvarint(fr.r)
+	switch {
+	case err == io.EOF:
+		return io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("binpack: frame length: %w", ErrShortBuffer)
+	case err != nil:
+		return fmt.Errorf("binpack: frame length: %w", ErrBadValue)
+	case size > uint64(fr.MaxSize):
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrLengthTooLarge)
+	}
+
+	if uint64(cap(fr.buf)) < size {
+		fr.buf = make([]byte, size)
+	}
+	fr.buf = fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, fr.buf); err != nil {
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrShortBuffer)
+	}
+	return m.Unpack(fr.buf)
+}
+
+// FrameWriter пишет записи для FrameReader
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write пакует m и пишет её одной записью
+func (fw *FrameWriter) Write(m Message) error {
+	var err error
+	// длина известна только после упаковки, поэтому префикс пишется отдельно
+	if fw.buf, err = m.AppendPack(fw.buf[:0]); err != nil {
+		return err
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(fw.buf)))
+	if _, err = fw.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = fw.w.Write(fw.buf)
+	return err
+}
+
+func (in *CreateParams) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *CreateParams) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *CreateParams) decodeBinpack(d *binpackDecoder) {
+	// Login
+	d.begin(binary.LittleEndian)
+	in.Login = d.string(d.length(d.varint(), 0))
+	if d.failed("CreateParams", "Login") {
+		return
+	}
+	// Name
+	d.begin(binary.LittleEndian)
+	in.Name = d.string(d.length(d.varint(), 0))
+	if d.failed("CreateParams", "Name") {
+		return
+	}
+	// Status
+	d.begin(binary.LittleEndian)
+	in.Status = d.string(d.length(d.varint(), 0))
+	if d.failed("CreateParams", "Status") {
+		return
+	}
+	// Age
+	d.begin(binary.LittleEndian)
+	in.Age = int(d.uint32())
+	if d.failed("CreateParams", "Age") {
+		return
+	}
+}
+
+func (in *CreateParams) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *CreateParams) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *CreateParams) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *CreateParams) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// Login
+	dst = binary.AppendUvarint(dst, uint64(len(in.Login)))
+	dst = append(dst, in.Login...)
+	// Name
+	dst = binary.AppendUvarint(dst, uint64(len(in.Name)))
+	dst = append(dst, in.Name...)
+	// Status
+	dst = binary.AppendUvarint(dst, uint64(len(in.Status)))
+	dst = append(dst, in.Status...)
+	// Age
+	if int64(in.Age) < 0 || uint64(in.Age) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "CreateParams", Field: "Age", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(in.Age))
+	return dst, nil
+}
+
+func (in *User) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *User) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *User) decodeBinpack(d *binpackDecoder) {
+	// ID
+	d.begin(binary.LittleEndian)
+	in.ID = d.uint64()
+	if d.failed("User", "ID") {
+		return
+	}
+	// Login
+	d.begin(binary.LittleEndian)
+	in.Login = d.string(d.length(d.varint(), 0))
+	if d.failed("User", "Login") {
+		return
+	}
+	// FullName
+	d.begin(binary.LittleEndian)
+	in.FullName = d.string(d.length(d.varint(), 0))
+	if d.failed("User", "FullName") {
+		return
+	}
+	// Status
+	d.begin(binary.LittleEndian)
+	in.Status = int(d.uint32())
+	if d.failed("User", "Status") {
+		return
+	}
+}
+
+func (in *User) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *User) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *User) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *User) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// ID
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(in.ID))
+	// Login
+	dst = binary.AppendUvarint(dst, uint64(len(in.Login)))
+	dst = append(dst, in.Login...)
+	// FullName
+	dst = binary.AppendUvarint(dst, uint64(len(in.FullName)))
+	dst = append(dst, in.FullName...)
+	// Status
+	if int64(in.Status) < 0 || uint64(in.Status) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "User", Field: "Status", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(in.Status))
+	return dst, nil
+}
+
+// NewUserPackTemplate - тот же формат для pack и unpack в perl
+const NewUserPackTemplate = "Q<"
+
+func (in *NewUser) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *NewUser) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *NewUser) decodeBinpack(d *binpackDecoder) {
+	// ID
+	d.begin(binary.LittleEndian)
+	in.ID = d.uint64()
+	if d.failed("NewUser", "ID") {
+		return
+	}
+}
+
+func (in *NewUser) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *NewUser) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *NewUser) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *NewUser) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// ID
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(in.ID))
+	return dst, nil
+}
+
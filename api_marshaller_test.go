@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func testCreateParamsValue() CreateParams {
+	return CreateParams{
+		Login: "Login value",
+		Name: "Name value",
+		Status: "Status value",
+		Age: 4000012,
+	}
+}
+
+func TestCreateParamsPackRoundTrip(t *testing.T) {
+	in := testCreateParamsValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := CreateParams{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestCreateParamsUnpackTruncated(t *testing.T) {
+	in := testCreateParamsValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := CreateParams{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestCreateParamsStream(t *testing.T) {
+	in := testCreateParamsValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := CreateParams{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&CreateParams{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&CreateParams{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestCreateParamsFrames(t *testing.T) {
+	in := testCreateParamsValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := CreateParams{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&CreateParams{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkCreateParamsUnpack(b *testing.B) {
+	in := testCreateParamsValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := CreateParams{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkCreateParamsUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkCreateParamsUnpackReflect(b *testing.B) {
+	in := testCreateParamsValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := CreateParams{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkCreateParamsAppendPack(b *testing.B) {
+	in := testCreateParamsValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func testUserValue() User {
+	return User{
+		ID: 1099511627777,
+		Login: "Login value",
+		FullName: "FullName value",
+		Status: 4000012,
+	}
+}
+
+func TestUserPackRoundTrip(t *testing.T) {
+	in := testUserValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := User{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestUserUnpackTruncated(t *testing.T) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := User{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestUserStream(t *testing.T) {
+	in := testUserValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := User{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&User{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&User{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestUserFrames(t *testing.T) {
+	in := testUserValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := User{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&User{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkUserUnpack(b *testing.B) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := User{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkUserUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkUserUnpackReflect(b *testing.B) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := User{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkUserAppendPack(b *testing.B) {
+	in := testUserValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func testNewUserValue() NewUser {
+	return NewUser{
+		ID: 1099511627777,
+	}
+}
+
+func TestNewUserPackRoundTrip(t *testing.T) {
+	in := testNewUserValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := NewUser{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestNewUserUnpackTruncated(t *testing.T) {
+	in := testNewUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := NewUser{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestNewUserStream(t *testing.T) {
+	in := testNewUserValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := NewUser{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&NewUser{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&NewUser{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestNewUserFrames(t *testing.T) {
+	in := testNewUserValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := NewUser{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&NewUser{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestNewUserUnpackNoAlloc(t *testing.T) {
+	in := testNewUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	out := NewUser{}
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := out.Unpack(data); err != nil {
+			t.Fatalf("Unpack error: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Unpack must not allocate, got %v allocs", allocs)
+	}
+}
+
+func BenchmarkNewUserUnpack(b *testing.B) {
+	in := testNewUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := NewUser{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkNewUserUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkNewUserUnpackReflect(b *testing.B) {
+	in := testNewUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := NewUser{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkNewUserAppendPack(b *testing.B) {
+	in := testNewUserValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets - границы гистограммы времени ответа в секундах, как в клиенте prometheus
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics собирает счётчики сгенерированных методов и отдаёт их в текстовом формате prometheus
+type Metrics struct {
+	mu        sync.Mutex
+	buckets   []float64
+	requests  map[metricLabels]uint64
+	durations map[metricLabels]*histogram
+	inFlight  map[metricLabels]int64
+}
+
+type metricLabels struct {
+	receiver string
+	endpoint string
+	method   string
+	status   string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// DefaultMetrics используется, если ни у получателя, ни в GlobalRuntime не задан свой Metrics
+var DefaultMetrics = NewMetrics(DefaultBuckets)
+
+func NewMetrics(buckets []float64) *Metrics {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+
+	return &Metrics{
+		buckets:   sorted,
+		requests:  map[metricLabels]uint64{},
+		durations: map[metricLabels]*histogram{},
+		inFlight:  map[metricLabels]int64{},
+	}
+}
+
+// MetricsHandler - обработчик для /metrics с метриками по умолчанию
+func MetricsHandler() http.Handler {
+	return DefaultMetrics
+}
+
+func (ar *ApiRuntime) metrics() *Metrics {
+	if ar.Metrics != nil {
+		return ar.Metrics
+	}
+	if GlobalRuntime.Metrics != nil {
+		return GlobalRuntime.Metrics
+	}
+	return DefaultMetrics
+}
+
+func (m *Metrics) begin(ep *apiEndpoint, r *http.Request) {
+	labels := metricLabels{receiver: ep.Service.Name, endpoint: ep.Url, method: metricMethod(r.Method)}
+
+	m.mu.Lock()
+	m.inFlight[labels]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) end(ep *apiEndpoint, r *http.Request, status int, latency time.Duration) {
+	labels := metricLabels{receiver: ep.Service.Name, endpoint: ep.Url, method: metricMethod(r.Method)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight[labels]--
+
+	labels.status = strconv.Itoa(status)
+	m.requests[labels]++
+
+	h, ok := m.durations[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.durations[labels] = h
+	}
+	seconds := latency.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metricMethod не даёт произвольным методам раздувать число рядов
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(rw)
+}
+
+// WriteTo пишет все метрики в текстовом формате prometheus, ряды отсортированы по меткам
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &strings.Builder{}
+
+	fmt.Fprintln(out, "# HELP apigen_requests_total Requests handled by generated endpoints.")
+	fmt.Fprintln(out, "# TYPE apigen_requests_total counter")
+	for _, labels := range sortedMetricLabels(m.requests) {
+		fmt.Fprintf(out, "apigen_requests_total{%s} %d\n", labels.format(), m.requests[labels])
+	}
+
+	fmt.Fprintln(out, "# HELP apigen_request_duration_seconds Latency of generated endpoints.")
+	fmt.Fprintln(out, "# TYPE apigen_request_duration_seconds histogram")
+	for _, labels := range sortedMetricLabels(m.durations) {
+		h := m.durations[labels]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels.format(), strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels.format(), h.count)
+		fmt.Fprintf(out, "apigen_request_duration_seconds_sum{%s} %s\n", labels.format(), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "apigen_request_duration_seconds_count{%s} %d\n", labels.format(), h.count)
+	}
+
+	fmt.Fprintln(out, "# HELP apigen_requests_in_flight Requests being handled by generated endpoints.")
+	fmt.Fprintln(out, "# TYPE apigen_requests_in_flight gauge")
+	for _, labels := range sortedMetricLabels(m.inFlight) {
+		fmt.Fprintf(out, "apigen_requests_in_flight{%s} %d\n", labels.format(), m.inFlight[labels])
+	}
+
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+func (ml metricLabels) format() string {
+	labels := fmt.Sprintf("receiver=\"%s\",endpoint=\"%s\",method=\"%s\"",
+		escapeLabelValue(ml.receiver), escapeLabelValue(ml.endpoint), escapeLabelValue(ml.method))
+	if ml.status != "" {
+		labels += ",status=\"" + ml.status + "\""
+	}
+	return labels
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func sortedMetricLabels[V any](series map[metricLabels]V) []metricLabels {
+	keys := make([]metricLabels, 0, len(series))
+	for labels := range series {
+		keys = append(keys, labels)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].format() < keys[j].format()
+	})
+	return keys
+}
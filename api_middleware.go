@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware оборачивает сгенерированный обработчик метода так же, как это принято в net/http
+type Middleware func(http.Handler) http.Handler
+
+// ApiRuntime - настройки, которые сгенерированный код берёт у получателя во время работы.
+// Встраивается в структуру получателя, то, что задано в GlobalRuntime, действует на все получатели
+type ApiRuntime struct {
+	// Middlewares - реестр именованных middleware для "middleware" из apigen:api
+	Middlewares map[string]Middleware
+	// Use оборачивает все методы получателя
+	Use []Middleware
+	// OnPanic вызывается после восстановления после паники в методе, например чтобы отправить её в трекер ошибок
+	OnPanic func(r *http.Request, endpoint string, recovered interface{}, stack []byte)
+	// Logger - куда писать журнал запросов, по умолчанию slog.Default()
+	Logger *slog.Logger
+	// Principal - кто выполняет запрос после успешной авторизации, по умолчанию хэш X-Auth
+	Principal func(r *http.Request) string
+	// Metrics - куда считать запросы, по умолчанию DefaultMetrics
+	Metrics *Metrics
+	// RateLimitStore - где хранить вёдра для "rate_limit", по умолчанию общее хранилище в памяти
+	RateLimitStore RateLimitStore
+	// IdempotencyStore и IdempotencyTTL - где и сколько хранить ответы методов с "idempotent": true
+	IdempotencyStore IdempotencyStore
+	IdempotencyTTL   time.Duration
+	// CompressMinSize - с какого размера сжимать ответы методов с "compress": true
+	CompressMinSize int
+}
+
+var GlobalRuntime = &ApiRuntime{}
+
+func (ar *ApiRuntime) apiRuntime() *ApiRuntime {
+	return ar
+}
+
+// RegisterMiddleware добавляет middleware в реестр под именем для "middleware" из apigen:api
+func (ar *ApiRuntime) RegisterMiddleware(name string, middleware Middleware) {
+	if ar.Middlewares == nil {
+		ar.Middlewares = map[string]Middleware{}
+	}
+	ar.Middlewares[name] = middleware
+}
+
+// runtimeOf достаёт ApiRuntime из получателя, если тот его не встраивает - работаем с глобальным
+func runtimeOf(srv interface{}) *ApiRuntime {
+	if withRuntime, ok := srv.(interface{ apiRuntime() *ApiRuntime }); ok {
+		return withRuntime.apiRuntime()
+	}
+	return GlobalRuntime
+}
+
+// middleware ищет имя сначала у получателя, потом в глобальном реестре
+func (ar *ApiRuntime) middleware(name string) (Middleware, bool) {
+	if middleware, ok := ar.Middlewares[name]; ok {
+		return middleware, true
+	}
+	middleware, ok := GlobalRuntime.Middlewares[name]
+	return middleware, ok
+}
+
+// chain собирает обработчик: глобальные Use, потом Use получателя, потом middleware метода
+func (ar *ApiRuntime) chain(ep *apiEndpoint, handler http.Handler) (http.Handler, error) {
+	middlewares := make([]Middleware, 0, len(GlobalRuntime.Use)+len(ar.Use)+len(ep.Middleware))
+	middlewares = append(middlewares, GlobalRuntime.Use...)
+	if ar != GlobalRuntime {
+		middlewares = append(middlewares, ar.Use...)
+	}
+	for _, name := range ep.Middleware {
+		middleware, ok := ar.middleware(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		middlewares = append(middlewares, middleware)
+	}
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler, nil
+}
+
+func (ar *ApiRuntime) onPanic() func(r *http.Request, endpoint string, recovered interface{}, stack []byte) {
+	if ar.OnPanic != nil {
+		return ar.OnPanic
+	}
+	return GlobalRuntime.OnPanic
+}
+
+// serveEndpoint - общая часть всех сгенерированных методов, вызывается из ServeHTTP
+func serveEndpoint(rt *ApiRuntime, ep *apiEndpoint, handler http.Handler, rw http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	info := &requestInfo{}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+	recorder := &responseRecorder{ResponseWriter: rw}
+
+	metrics := rt.metrics()
+	metrics.begin(ep, r)
+	defer func() {
+		latency := time.Since(started)
+		metrics.end(ep, r, recorder.statusCode(), latency)
+		logRequest(rt, ep, recorder, r, info, latency)
+	}()
+	defer recoverEndpoint(rt, ep, recorder, r)
+
+	if applyCORS(ep, recorder, r) {
+		return
+	}
+	if !allowRequest(rt, ep, recorder, r, false) {
+		return
+	}
+	if !decompressRequest(ep, recorder, r) || !limitRequest(ep, recorder, r) {
+		return
+	}
+	defer clearReadDeadline(r)
+
+	handler, err := rt.chain(ep, handler)
+	if err != nil {
+		responseError(recorder, r, ep.Service, ApiError{HTTPStatus: http.StatusInternalServerError, Code: "internal", Err: err})
+		return
+	}
+	if ep.Idempotent {
+		handler = idempotent(rt, ep, handler)
+	}
+	if ep.ETag || ep.CacheControl != "" {
+		handler = conditional(ep, handler)
+	}
+	if ep.Compress {
+		handler = compress(rt, handler)
+	}
+	handler.ServeHTTP(recorder, r)
+}
+
+// recoverEndpoint превращает панику в методе в обычный ответ 500,
+// если ответ уже начал писаться - остаётся только оборвать соединение
+func recoverEndpoint(rt *ApiRuntime, ep *apiEndpoint, recorder *responseRecorder, r *http.Request) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+
+	endpoint := ep.fullName()
+	stack := debug.Stack()
+	rt.logger().LogAttrs(r.Context(), slog.LevelError, "panic in "+endpoint,
+		slog.String("panic", fmt.Sprint(recovered)),
+		slog.String("stack", string(stack)),
+	)
+
+	if onPanic := rt.onPanic(); onPanic != nil {
+		onPanic(r, endpoint, recovered, stack)
+	}
+
+	if recorder.wroteHeader {
+		panic(http.ErrAbortHandler)
+	}
+	responseError(recorder, r, ep.Service, ApiError{HTTPStatus: http.StatusInternalServerError, Code: "internal", Err: errors.New("internal error")})
+}
+
+// responseRecorder запоминает, что уже ушло клиенту
+type responseRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	size        int
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.wroteHeader = true
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	if !rr.wroteHeader {
+		rr.WriteHeader(http.StatusOK)
+	}
+	n, err := rr.ResponseWriter.Write(data)
+	rr.size += n
+	return n, err
+}
+
+// statusCode - статус ответа, если обработчик ничего не записал, net/http ответит 200
+func (rr *responseRecorder) statusCode() int {
+	if !rr.wroteHeader {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+// Unwrap нужен http.ResponseController, чтобы добраться до исходного ResponseWriter
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
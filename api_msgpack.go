@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// msgpackEncoder - MessagePack без внешних зависимостей, структуры пишутся map-ами с ключами из json-тегов
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) MediaTypes() []string {
+	return []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+}
+
+func (msgpackEncoder) Encode(v interface{}) ([]byte, error) {
+	return msgpackAppend(nil, reflect.ValueOf(v))
+}
+
+func msgpackAppend(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, 0xc0), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return msgpackAppend(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return msgpackAppendInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return msgpackAppendUint(buf, v.Uint()), nil
+	case reflect.Float32:
+		buf = append(buf, 0xca)
+		return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return msgpackAppendString(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return msgpackAppendBin(buf, v.Bytes()), nil
+		}
+		return msgpackAppendArray(buf, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return msgpackAppendBin(buf, data), nil
+		}
+		return msgpackAppendArray(buf, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = msgpackAppendHead(buf, 0x80, 0xde, 0xdf, v.Len(), 16)
+		for _, key := range sortedMapKeys(v) {
+			if key.Kind() != reflect.String && mapKeyString(key) == "" {
+				return nil, fmt.Errorf("msgpack: unsupported map key type %s", key.Type())
+			}
+			buf = msgpackAppendString(buf, mapKeyString(key))
+			var err error
+			if buf, err = msgpackAppend(buf, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		fields, values := encodableValues(v)
+		buf = msgpackAppendHead(buf, 0x80, 0xde, 0xdf, len(fields), 16)
+		for i, field := range fields {
+			buf = msgpackAppendString(buf, field.name)
+			var err error
+			if buf, err = msgpackAppend(buf, values[i]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+func msgpackAppendInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return msgpackAppendUint(buf, uint64(n))
+	case n >= -32:
+		return append(buf, byte(int8(n)))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(int8(n)))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(int16(n)))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(int32(n)))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+func msgpackAppendUint(buf []byte, n uint64) []byte {
+	switch {
+	case n < 128:
+		return append(buf, byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), n)
+}
+
+func msgpackAppendString(buf []byte, s string) []byte {
+	if len(s) < 32 {
+		buf = append(buf, 0xa0|byte(len(s)))
+	} else {
+		buf = msgpackAppendLen(buf, 0xd9, 0xda, 0xdb, len(s))
+	}
+	return append(buf, s...)
+}
+
+func msgpackAppendBin(buf []byte, data []byte) []byte {
+	buf = msgpackAppendLen(buf, 0xc4, 0xc5, 0xc6, len(data))
+	return append(buf, data...)
+}
+
+func msgpackAppendArray(buf []byte, v reflect.Value) ([]byte, error) {
+	buf = msgpackAppendHead(buf, 0x90, 0xdc, 0xdd, v.Len(), 16)
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if buf, err = msgpackAppend(buf, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// msgpackAppendHead - заголовок array/map: fix-форма для маленьких размеров, иначе 16 или 32 бита
+func msgpackAppendHead(buf []byte, fix, code16, code32 byte, n, fixLimit int) []byte {
+	if n < fixLimit {
+		return append(buf, fix|byte(n))
+	}
+	if n <= math.MaxUint16 {
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, code32), uint32(n))
+}
+
+// msgpackAppendLen - длина str/bin в 8, 16 или 32 бита
+func msgpackAppendLen(buf []byte, code8, code16, code32 byte, n int) []byte {
+	if n <= math.MaxUint8 {
+		return append(buf, code8, byte(n))
+	}
+	if n <= math.MaxUint16 {
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, code32), uint32(n))
+}
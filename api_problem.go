@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// ParamError - ошибка валидации конкретного параметра, её возвращает сгенерированный FilingAndValidate
+type ParamError struct {
+	Param string
+	Err   error
+}
+
+func (pe ParamError) Error() string {
+	return pe.Err.Error()
+}
+
+func (pe ParamError) Unwrap() error {
+	return pe.Err
+}
+
+type problemDetails struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Code     string         `json:"code,omitempty"`
+	Errors   []problemParam `json:"errors,omitempty"`
+}
+
+type problemParam struct {
+	Param  string `json:"param"`
+	Detail string `json:"detail"`
+}
+
+// responseProblem пишет ошибку в формате RFC 7807, для ApiError берёт из него статус и код
+func responseProblem(rw http.ResponseWriter, r *http.Request, svc *apiService, err error) {
+	apiErr := asApiError(err)
+	problem := problemDetails{
+		Type:     "about:blank",
+		Status:   apiErr.HTTPStatus,
+		Detail:   err.Error(),
+		Instance: r.URL.Path,
+		Code:     apiErr.Code,
+	}
+
+	var paramErr ParamError
+	if errors.As(err, &paramErr) {
+		problem.Errors = []problemParam{{Param: paramErr.Param, Detail: paramErr.Error()}}
+	}
+	if svc.ProblemType != "" && problem.Code != "" {
+		problem.Type = svc.ProblemType + problem.Code
+	}
+	problem.Title = http.StatusText(problem.Status)
+
+	response, _ := json.Marshal(problem)
+	rw.Header().Set("Content-Type", problemContentType)
+	rw.WriteHeader(problem.Status)
+	rw.Write(response)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitKeyIP        = "ip"
+	rateLimitKeyPrincipal = "principal"
+	rateLimitKeyHeader    = "header:"
+)
+
+// rateLimit - "rate_limit" и "rate_limit_key" из apigen:api, кодогенератор уже перевёл их в токены в секунду
+type rateLimit struct {
+	Rate  float64
+	Burst int
+	Key   string
+}
+
+// RateLimitStore хранит вёдра токенов, для нескольких экземпляров сервиса нужна общая реализация, например в redis
+type RateLimitStore interface {
+	// Take забирает токен из ведра key, если токенов нет - возвращает, через сколько появится следующий
+	Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration)
+}
+
+// MemoryRateLimitStore - вёдра в памяти процесса
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+var defaultRateLimitStore = NewMemoryRateLimitStore()
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+func (ms *MemoryRateLimitStore) Take(key string, rate float64, burst int) (bool, time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+
+	bucket, ok := ms.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		ms.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second)))
+	return true, 0
+}
+
+// sweep раз в минуту выкидывает вёдра, которые уже успели наполниться - они ничем не отличаются от новых
+func (ms *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < time.Minute {
+		return
+	}
+	ms.lastSweep = now
+
+	for key, bucket := range ms.buckets {
+		if !now.Before(bucket.full) {
+			delete(ms.buckets, key)
+		}
+	}
+}
+
+func (ar *ApiRuntime) rateLimitStore() RateLimitStore {
+	if ar.RateLimitStore != nil {
+		return ar.RateLimitStore
+	}
+	if GlobalRuntime.RateLimitStore != nil {
+		return GlobalRuntime.RateLimitStore
+	}
+	return defaultRateLimitStore
+}
+
+// allowRequest проверяет ограничение метода, при превышении сам отвечает 429 с Retry-After.
+// serveEndpoint вызывает её до метода, а ограничения с ключом principal проверяет сам сгенерированный
+// метод с afterAuth == true, когда уже известно, прошёл ли запрос авторизацию
+func allowRequest(rt *ApiRuntime, ep *apiEndpoint, rw http.ResponseWriter, r *http.Request, afterAuth bool) bool {
+	if ep.RateLimit == nil || (ep.RateLimit.Key == rateLimitKeyPrincipal) != afterAuth {
+		return true
+	}
+
+	key := ep.Service.Name + " " + ep.Url + " " + rateLimitKey(ep.RateLimit.Key, r)
+	ok, retryAfter := rt.rateLimitStore().Take(key, ep.RateLimit.Rate, ep.RateLimit.Burst)
+	if ok {
+		return true
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	responseError(rw, r, ep.Service, ApiError{HTTPStatus: http.StatusTooManyRequests, Code: "rate_limited", Err: errors.New("rate limit exceeded")})
+	return false
+}
+
+// rateLimitKey - чей это запрос, если выбранного признака нет - считаем по адресу клиента;
+// principal есть только у запросов, прошедших авторизацию, по одному заголовку ему верить нельзя
+func rateLimitKey(selector string, r *http.Request) string {
+	switch {
+	case selector == rateLimitKeyPrincipal:
+		if principal := PrincipalFrom(r.Context()); principal != "" {
+			return principal
+		}
+	case strings.HasPrefix(selector, rateLimitKeyHeader):
+		if value := r.Header.Get(strings.TrimPrefix(selector, rateLimitKeyHeader)); value != "" {
+			return value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+const (
+	errorFormatLegacy  = ""
+	errorFormatProblem = "problem"
+)
+
+// apiService описывает получатель с методами apigen:api,
+// кодогенератор заполняет его из комментария apigen:service над типом получателя
+type apiService struct {
+	Name string
+	// ErrorFormat - в каком виде отдавать ошибки: по умолчанию {"error": "..."},
+	// errorFormatProblem - application/problem+json по RFC 7807
+	ErrorFormat string
+	// ProblemType - префикс для поля type в problem+json, к нему дописывается код ошибки
+	ProblemType string
+	// Encoders - имена кодировщиков ответа из RegisterEncoder в порядке предпочтения, пусто - все
+	Encoders []string
+	// CORS - nil, если запросы из браузера с других источников не нужны
+	CORS *corsConfig
+}
+
+// apiEndpoint - один метод с аннотацией apigen:api
+type apiEndpoint struct {
+	Service *apiService
+	Name    string
+	Url     string
+	// Methods - разрешённые http-методы из "method" в apigen:api, пусто - любые
+	Methods []string
+	// Middleware - имена из реестра ApiRuntime.Middlewares, первое оборачивает все остальные
+	Middleware []string
+	RateLimit  *rateLimit
+	// Idempotent - повтор запроса с тем же Idempotency-Key получает сохранённый ответ
+	Idempotent bool
+	// ETag и CacheControl - условные GET: 304 на If-None-Match и заголовок Cache-Control
+	ETag         bool
+	CacheControl string
+	// MaxBody - предел тела запроса в байтах, больше - 413; ReadTimeout - дедлайн на чтение тела.
+	// Ноль - без ограничений, по умолчанию кодогенератор подставляет свои значения
+	MaxBody     int64
+	ReadTimeout time.Duration
+	// Compress - сжимать ответ gzip или deflate по Accept-Encoding
+	Compress bool
+}
+
+// fullName - имя для журналов: MyApi.Profile
+func (ep *apiEndpoint) fullName() string {
+	return ep.Service.Name + "." + ep.Name
+}
@@ -1,41 +1,988 @@
 // go build gen/* && ./codegen.exe pack/unpack.go  pack/marshaller.go
-// go run pack/*
+// go run ./pack
+// go test ./pack
+// go test -bench . ./pack
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"text/template"
 )
 
-type tpl struct {
+// packField - поле, которое попадает в бинарный формат
+type packField struct {
+	StructName string
+	Name       string
+	Wire       *wireType
+	// Order - порядок байт структуры: LittleEndian или BigEndian из binary
+	Order string
+	// MaxLen - предел длины строки, []byte или слайса из cgen:"maxlen=N", 0 - без предела
+	MaxLen int
+	// Since - версия структуры, в которой появилось поле, cgen:"since=N"
+	Since int
+}
+
+// structOptions - опции структуры из строки // cgen: binpack
+type structOptions struct {
+	Order   string
+	LenSize int
+	// Version - текущая версия из version=N, 0 - структура без заголовка версии
+	Version int
+	// Template - формат полей из template="L L/a* L", по одной букве pack на поле
+	Template []perlItem
+}
+
+// testTpl - данные для круговых тестов: значения полей структуры и самой структуры
+type testTpl struct {
+	StructName string
+	Fields     []testField
+	// NoAlloc - Unpack структуры не выделяет память, это проверяется тестом
+	NoAlloc bool
+	// Version, Order и NewFields - поля с since больше 1 - для тестов совместимости версий
+	Version   int
+	Order     string
+	NewFields []string
+}
+
+type testField struct {
 	FieldName string
+	Value     string
+	MaxLen    int
+	// Overlong - значение длиннее MaxLen
+	Overlong string
+	// Patch - код, который пишет в префикс длины поля MaxLen+1
+	Patch string
+	// Offset - где поле начинается в запакованном тестовом значении
+	Offset int
 }
 
 var (
-	intTpl = template.Must(template.New("intTpl").Parse(`
-	// {{.FieldName}}
-	var {{.FieldName}}Raw uint32
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}Raw)
-	in.{{.FieldName}} = int({{.FieldName}}Raw)
+	// общие для всех структур ошибки, пишутся в начало файла один раз
+	errorsTpl = template.Must(template.New("errorsTpl").Parse(`
+var (
+	// ErrShortBuffer - данные закончились раньше, чем структура
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrLengthTooLarge - длина строки больше maxlen из тега или больше, чем влезает в префикс длины
+	ErrLengthTooLarge = errors.New("length too large")
+	// ErrOutOfRange - число не помещается в поле бинарного формата
+	ErrOutOfRange = errors.New("value out of range")
+	// ErrBadValue - байт bool не 0 и не 1 или varint длиннее 10 байт
+	ErrBadValue = errors.New("bad value")
+)
+
+// FieldError - ошибка упаковки или распаковки поля, Offset - начало поля в данных
+type FieldError struct {
+	Struct string
+	Field  string
+	Offset int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("binpack: %s.%s at offset %d: %v", e.Struct, e.Field, e.Offset, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// binpackChunk - сколько байт или элементов слайса выделять сразу при чтении из потока
+const binpackChunk = 4096
+
+// binpackReader - источник данных декодера, varint читается по байту
+type binpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// binpackDecoder читает значения по порядку; первая ошибка запоминается, после неё читаются нули.
+// Unpack читает прямо из слайса data, без binary.Read и рефлексии, DecodeFrom - из потока stream
+type binpackDecoder struct {
+	data   []byte
+	stream *binpackStream
+	// end - где кончаются данные или тело версионной структуры, -1 - поток без предела
+	end int
+	// offset - сколько байт data уже прочитано
+	offset int
+	order  binary.ByteOrder
+	// field - начало текущего поля, для FieldError
+	field int
+	err   error
+}
+
+func newBinpackDecoder(data []byte) *binpackDecoder {
+	return &binpackDecoder{data: data, end: len(data), order: binary.LittleEndian}
+}
+
+// newBinpackStreamDecoder читает из потока ровно столько байт, сколько занимает структура,
+// поэтому структуры можно читать из одного потока подряд
+func newBinpackStreamDecoder(r io.Reader) *binpackDecoder {
+	br, ok := r.(binpackReader)
+	if !ok {
+		br = &binpackByteReader{Reader: r}
+	}
+	return &binpackDecoder{stream: &binpackStream{r: br, end: -1}, end: -1, order: binary.LittleEndian}
+}
+
+// binpackStream считает прочитанные из потока байты для смещений в FieldError;
+// он отдельно от декодера, чтобы декодер Unpack не уходил в кучу через интерфейсы io
+type binpackStream struct {
+	r binpackReader
+	n int
+	// end - конец тела версионной структуры, дальше поток читается только через leave
+	end int
+}
+
+func (s *binpackStream) Read(p []byte) (int, error) {
+	if s.end >= 0 {
+		if s.n >= s.end {
+			return 0, io.EOF
+		}
+		if len(p) > s.end-s.n {
+			p = p[:s.end-s.n]
+		}
+	}
+	n, err := s.r.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *binpackStream) ReadByte() (byte, error) {
+	if s.end >= 0 && s.n >= s.end {
+		return 0, io.EOF
+	}
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.n++
+	}
+	return b, err
+}
+
+// binpackByteReader читает по одному байту без буфера, чтобы не забрать из потока лишнего;
+// для скорости в DecodeFrom лучше передать *bufio.Reader
+type binpackByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *binpackByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.Reader, r.b[:])
+	return r.b[0], err
+}
+
+// pos - сколько байт уже прочитано
+func (d *binpackDecoder) pos() int {
+	if d.stream != nil {
+		return d.stream.n
+	}
+	return d.offset
+}
+
+// begin отмечает начало поля; порядок байт ставится заново, потому что вложенная структура могла его поменять
+func (d *binpackDecoder) begin(order binary.ByteOrder) {
+	d.field = d.pos()
+	d.order = order
+}
+
+// streamErr - результат DecodeFrom: если поток кончился до первого байта структуры, это io.EOF, как у binary.Read
+func (d *binpackDecoder) streamErr() error {
+	if d.pos() == 0 && errors.Is(d.err, ErrShortBuffer) {
+		return io.EOF
+	}
+	return d.err
+}
+
+// enter читает заголовок версионной структуры - версию и длину тела - и ограничивает чтение телом;
+// outer - прежний предел, его возвращает leave
+func (d *binpackDecoder) enter() (version uint64, outer int) {
+	version = d.varint()
+	size := d.length(uint64(d.uint32()), 0)
+	outer = d.end
+	if d.err == nil {
+		d.setEnd(d.pos() + size)
+	}
+	return version, outer
+}
+
+// leave пропускает непрочитанный конец тела - поля из более новой версии - и возвращает внешний предел
+func (d *binpackDecoder) leave(outer int) {
+	if d.err == nil && d.pos() < d.end {
+		if d.stream == nil {
+			d.offset = d.end
+		} else {
+			_, d.err = io.CopyN(io.Discard, d.stream, int64(d.end-d.pos()))
+		}
+	}
+	d.setEnd(outer)
+}
+
+func (d *binpackDecoder) setEnd(end int) {
+	d.end = end
+	if d.stream != nil {
+		d.stream.end = end
+	}
+}
+
+// failed заворачивает ошибку в FieldError, ошибки вложенных структур уже завёрнуты
+func (d *binpackDecoder) failed(structName, field string) bool {
+	if d.err == nil {
+		return false
+	}
+	var fieldErr *FieldError
+	if !errors.As(d.err, &fieldErr) {
+		if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+			d.err = ErrShortBuffer
+		}
+		d.err = &FieldError{Struct: structName, Field: field, Offset: d.field, Err: d.err}
+	}
+	return true
+}
+
+func (d *binpackDecoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.stream, d.order, v)
+	}
+}
+
+// take отдаёт следующие n байт из data без копирования, nil - данные кончились или уже была ошибка
+func (d *binpackDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > d.end-d.offset {
+		d.err = ErrShortBuffer
+		return nil
+	}
+	v := d.data[d.offset : d.offset+n : d.offset+n]
+	d.offset += n
+	return v
+}
+
+func (d *binpackDecoder) uint8() uint8 {
+	if d.stream == nil {
+		if b := d.take(1); b != nil {
+			return b[0]
+		}
+		return 0
+	}
+	var v uint8
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint16() uint16 {
+	if d.stream == nil {
+		if b := d.take(2); b != nil {
+			return d.order.Uint16(b)
+		}
+		return 0
+	}
+	var v uint16
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint32() uint32 {
+	if d.stream == nil {
+		if b := d.take(4); b != nil {
+			return d.order.Uint32(b)
+		}
+		return 0
+	}
+	var v uint32
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint64() uint64 {
+	if d.stream == nil {
+		if b := d.take(8); b != nil {
+			return d.order.Uint64(b)
+		}
+		return 0
+	}
+	var v uint64
+	d.read(&v)
+	return v
+}
+
+// varint читает LEB128, как в protobuf
+func (d *binpackDecoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if d.stream == nil {
+		v, n := binary.Uvarint(d.data[d.offset:d.end])
+		switch {
+		case n == 0:
+			d.err = ErrShortBuffer
+		case n < 0:
+			d.err = ErrBadValue
+		default:
+			d.offset += n
+		}
+		return v
+	}
+	v, err := binary.ReadUvarint(d.stream)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.err = err
+	case err != nil:
+		d.err = ErrBadValue
+	}
+	return v
+}
+
+// zigzag читает знаковый varint, как sint64 в protobuf, и возвращает его биты
+func (d *binpackDecoder) zigzag() uint64 {
+	v := d.varint()
+	return uint64(int64(v>>1) ^ -int64(v&1))
+}
+
+func (d *binpackDecoder) bool() bool {
+	v := d.uint8()
+	if v > 1 && d.err == nil {
+		d.err = ErrBadValue
+	}
+	return v == 1
+}
+
+func (d *binpackDecoder) float32() float32 {
+	return math.Float32frombits(d.uint32())
+}
+
+func (d *binpackDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// checkUint и checkInt - значение из данных не помещается в тип поля
+func (d *binpackDecoder) checkUint(v, max uint64) uint64 {
+	if v > max && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+func (d *binpackDecoder) checkInt(v, min, max int64) int64 {
+	if (v < min || v > max) && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+// length проверяет прочитанный префикс длины до всякого make,
+// чтобы испорченный префикс не просил гигабайты
+func (d *binpackDecoder) length(n uint64, maxLen int) int {
+	switch {
+	case d.err != nil:
+		return 0
+	case maxLen > 0 && n > uint64(maxLen):
+		d.err = ErrLengthTooLarge
+		return 0
+	case d.end >= 0 && n > uint64(d.end-d.pos()):
+		d.err = ErrShortBuffer
+		return 0
+	case n > math.MaxInt32:
+		// столько в память всё равно не поместить
+		d.err = ErrLengthTooLarge
+		return 0
+	}
+	return int(n)
+}
+
+// capacity - сколько элементов слайса выделить сразу; в потоке длину нечем проверить
+// (длина тела версионной структуры тоже только заявлена), поэтому слайс растёт по мере чтения
+func (d *binpackDecoder) capacity(n int) int {
+	if d.stream != nil && n > binpackChunk {
+		return binpackChunk
+	}
+	return n
+}
+
+func (d *binpackDecoder) bytes(n int) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if d.stream == nil {
+		return append([]byte(nil), d.take(n)...)
+	}
+	if d.stream != nil && n > binpackChunk {
+		buf := bytes.Buffer{}
+		buf.Grow(binpackChunk)
+		_, d.err = io.CopyN(&buf, d.stream, int64(n))
+		return buf.Bytes()
+	}
+	v := make([]byte, n)
+	_, d.err = io.ReadFull(d.stream, v)
+	return v
+}
+
+// string копирует байты строки один раз, без промежуточного []byte
+func (d *binpackDecoder) string(n int) string {
+	if d.stream == nil {
+		return string(d.take(n))
+	}
+	return string(d.bytes(n))
+}
+
+// alias и aliasString для cgen:"noalloc" ссылаются на данные Unpack без копирования,
+// такие поля живут, пока данные не меняют; из потока ссылаться не на что, там это обычное чтение
+func (d *binpackDecoder) alias(n int) []byte {
+	if d.stream == nil {
+		if n == 0 {
+			return nil
+		}
+		return d.take(n)
+	}
+	return d.bytes(n)
+}
+
+func (d *binpackDecoder) aliasString(n int) string {
+	if d.stream == nil {
+		if b := d.take(n); len(b) > 0 {
+			return unsafe.String(&b[0], len(b))
+		}
+		return ""
+	}
+	return string(d.bytes(n))
+}
+
+func (d *binpackDecoder) fill(v []byte) {
+	switch {
+	case d.stream == nil:
+		copy(v, d.take(len(v)))
+	case d.err == nil:
+		_, d.err = io.ReadFull(d.stream, v)
+	}
+}
+
+func binpackBool(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+`))
+
+	// записи с префиксом длины для чтения из сокета или файла, тоже пишутся один раз
+	framesTpl = template.Must(template.New("framesTpl").Parse(`
+// Message - структура с // cgen: binpack
+type Message interface {
+	Unpack(data []byte) error
+	AppendPack(dst []byte) ([]byte, error)
+}
+
+// DefaultMaxFrameSize - предел длины записи у FrameReader по умолчанию
+const DefaultMaxFrameSize = 16 << 20
+
+// FrameReader читает поток записей с префиксом длины varint, как writeDelimitedTo в protobuf;
+// в памяти держится только текущая запись, поэтому поля cgen:"noalloc" живут до следующего Next
+type FrameReader struct {
+	r *bufio.Reader
+	// MaxSize - предел длины одной записи, чтобы испорченный префикс не просил гигабайты
+	MaxSize int
+	buf     []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), MaxSize: DefaultMaxFrameSize}
+}
+
+// Next читает следующую запись в m, когда записи кончились - возвращает io.EOF
+func (fr *FrameReader) Next(m Message) error {
+	size, err := binary.ReadUvarint(fr.r)
+	switch {
+	case err == io.EOF:
+		return io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("binpack: frame length: %w", ErrShortBuffer)
+	case err != nil:
+		return fmt.Errorf("binpack: frame length: %w", ErrBadValue)
+	case size > uint64(fr.MaxSize):
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrLengthTooLarge)
+	}
+
+	if uint64(cap(fr.buf)) < size {
+		fr.buf = make([]byte, size)
+	}
+	fr.buf = fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, fr.buf); err != nil {
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrShortBuffer)
+	}
+	return m.Unpack(fr.buf)
+}
+
+// FrameWriter пишет записи для FrameReader
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write пакует m и пишет её одной записью
+func (fw *FrameWriter) Write(m Message) error {
+	var err error
+	// длина известна только после упаковки, поэтому префикс пишется отдельно
+	if fw.buf, err = m.AppendPack(fw.buf[:0]); err != nil {
+		return err
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(fw.buf)))
+	if _, err = fw.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = fw.w.Write(fw.buf)
+	return err
+}
 `))
 
-	strTpl = template.Must(template.New("strTpl").Parse(`
-	// {{.FieldName}}
-	var {{.FieldName}}LenRaw uint32
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}LenRaw)
-	{{.FieldName}}Raw := make([]byte, {{.FieldName}}LenRaw)
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}Raw)
-	in.{{.FieldName}} = string({{.FieldName}}Raw)
+	testHeaderTpl = template.Must(template.New("testHeaderTpl").Parse(`package {{.Package}}
+
+import (
+	"bytes"
+{{- if .WithBinary}}
+	"encoding/binary"
+{{- end}}
+	"errors"
+	"io"
+	"reflect"
+{{- if .WithStrings}}
+	"strings"
+{{- end}}
+	"testing"
+)
+`))
+
+	roundTripTestTpl = template.Must(template.New("roundTripTestTpl").Parse(`
+func test{{.StructName}}Value() {{.StructName}} {
+	return {{.StructName}}{
+{{- range .Fields}}
+		{{.FieldName}}: {{.Value}},
+{{- end}}
+	}
+}
+
+func Test{{.StructName}}PackRoundTrip(t *testing.T) {
+	in := test{{.StructName}}Value()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := {{.StructName}}{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func Test{{.StructName}}UnpackTruncated(t *testing.T) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := {{.StructName}}{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func Test{{.StructName}}Stream(t *testing.T) {
+	in := test{{.StructName}}Value()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := {{.StructName}}{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&{{.StructName}}{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&{{.StructName}}{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func Test{{.StructName}}Frames(t *testing.T) {
+	in := test{{.StructName}}Value()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := {{.StructName}}{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&{{.StructName}}{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+{{- if .Version}}
+
+// старые данные: поля новых версий в них считаются неизвестным хвостом и обнуляются
+func Test{{.StructName}}OlderVersion(t *testing.T) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	data[0] = 1
+
+	want := in
+{{- if .NewFields}}
+	zero := {{.StructName}}{}
+{{- range .NewFields}}
+	want.{{.}} = zero.{{.}}
+{{- end}}
+{{- end}}
+
+	out := test{{.StructName}}Value()
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(want, out) {
+		t.Errorf("version 1 mismatch:\nwant %#v\ngot  %#v", want, out)
+	}
+}
+
+// данные новой версии: неизвестные поля в конце тела пропускаются, в том числе в потоке
+func Test{{.StructName}}NewerVersion(t *testing.T) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	data[0] = {{.Version}} + 1
+	data = append(data, "new fields"...)
+	binary.{{.Order}}.PutUint32(data[1:], binary.{{.Order}}.Uint32(data[1:])+uint32(len("new fields")))
+
+	out := {{.StructName}}{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unpack mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	r := struct{ io.Reader }{bytes.NewReader(append(data, data...))}
+	for i := 0; i < 2; i++ {
+		out := {{.StructName}}{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+}
+{{- end}}
+{{- if .NoAlloc}}
+
+func Test{{.StructName}}UnpackNoAlloc(t *testing.T) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	out := {{.StructName}}{}
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := out.Unpack(data); err != nil {
+			t.Fatalf("Unpack error: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Unpack must not allocate, got %v allocs", allocs)
+	}
+}
+{{- end}}
+
+func Benchmark{{.StructName}}Unpack(b *testing.B) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := {{.StructName}}{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// Benchmark{{.StructName}}UnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func Benchmark{{.StructName}}UnpackReflect(b *testing.B) {
+	in := test{{.StructName}}Value()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := {{.StructName}}{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func Benchmark{{.StructName}}AppendPack(b *testing.B) {
+	in := test{{.StructName}}Value()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+{{- range .Fields}}
+{{- if .MaxLen}}
+
+func Test{{$.StructName}}{{.FieldName}}MaxLen(t *testing.T) {
+	in := test{{$.StructName}}Value()
+	in.{{.FieldName}} = {{.Overlong}}
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+{{- if .Patch}}
+
+	valid := test{{$.StructName}}Value()
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	{{.Patch}}
+
+	out := {{$.StructName}}{}
+	err = out.Unpack(data)
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrLengthTooLarge) || !errors.As(err, &fieldErr) || fieldErr.Field != "{{.FieldName}}" || fieldErr.Offset != {{.Offset}} {
+		t.Errorf("Unpack: expected ErrLengthTooLarge for {{.FieldName}} at offset {{.Offset}}, got %v", err)
+	}
+{{- end}}
+}
+{{- end}}
+{{- end}}
 `))
 )
 
+func overlong(field packField) string {
+	switch field.Wire.Kind {
+	case "string":
+		return fmt.Sprintf("strings.Repeat(\"x\", %d)", field.MaxLen+1)
+	case "bytes":
+		return fmt.Sprintf("%s(strings.Repeat(\"x\", %d))", field.Wire.GoType, field.MaxLen+1)
+	}
+	return fmt.Sprintf("make(%s, %d)", field.Wire.GoType, field.MaxLen+1)
+}
+
+// lengthPatch - пусто, если MaxLen+1 не помещается в префикс: тогда испортить длину для теста нечем
+func lengthPatch(field packField, offset int) string {
+	if field.MaxLen == 0 || !field.Wire.fitsLen(uint64(field.MaxLen+1)) {
+		return ""
+	}
+	switch field.Wire.LenSize {
+	case 0:
+		return fmt.Sprintf("binary.PutUvarint(data[%d:], %d)", offset, field.MaxLen+1)
+	case 1:
+		return fmt.Sprintf("data[%d] = %d", offset, field.MaxLen+1)
+	}
+	return fmt.Sprintf("binary.%s.PutUint%d(data[%d:], %d)", field.Order, field.Wire.LenSize*8, offset, field.MaxLen+1)
+}
+
+// parseFieldTag разбирает тег cgen: "-" - поле не пакуется, остальное - опции через запятую
+func parseFieldTag(field *packField, tag string) (skip bool, err error) {
+	if tag == "-" {
+		return true, nil
+	}
+	width, varint := "", ""
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(option, "=")
+		if size, ok := intWidths[name]; ok && value == "" {
+			if !field.Wire.setWidth(size.size, size.signed) {
+				return false, fmt.Errorf("%s: %s is only for integers", field.Name, name)
+			}
+			width = name
+			continue
+		}
+		switch name {
+		case "noalloc":
+			if !field.Wire.setNoAlloc() {
+				return false, fmt.Errorf("%s: noalloc is only for strings and []byte", field.Name)
+			}
+		case "varint", "zigzag":
+			if !field.Wire.setVarint(name) {
+				return false, fmt.Errorf("%s: %s is only for integers", field.Name, name)
+			}
+			varint = name
+		case "len":
+			size, err := parseLenSize(value)
+			if err != nil {
+				return false, fmt.Errorf("%s: %v", field.Name, err)
+			}
+			if !field.Wire.setLenSize(size) {
+				return false, fmt.Errorf("%s: len is only for strings, []byte and slices", field.Name)
+			}
+		case "since":
+			if field.Since, err = strconv.Atoi(value); err != nil || field.Since <= 0 {
+				return false, fmt.Errorf("%s: bad since %q", field.Name, value)
+			}
+		case "maxlen":
+			if kind := field.Wire.Kind; kind != "string" && kind != "bytes" && kind != "slice" {
+				return false, fmt.Errorf("%s: maxlen is only for strings, []byte and slices", field.Name)
+			}
+			if field.MaxLen, err = strconv.Atoi(value); err != nil || field.MaxLen <= 0 {
+				return false, fmt.Errorf("%s: bad maxlen %q", field.Name, value)
+			}
+		default:
+			return false, fmt.Errorf("%s: unknown cgen option %q", field.Name, option)
+		}
+	}
+	if width != "" && varint != "" {
+		return false, fmt.Errorf("%s: %s and %s together", field.Name, width, varint)
+	}
+	// предел должен помещаться в префикс длины, иначе тег врёт
+	if field.MaxLen > 0 && !field.Wire.fitsLen(uint64(field.MaxLen)) {
+		return false, fmt.Errorf("%s: maxlen %d does not fit into %d byte length", field.Name, field.MaxLen, field.Wire.LenSize)
+	}
+	return false, nil
+}
+
+// parseLenSize - ширина префикса длины: u8..u64 или varint, у varint ширина 0
+func parseLenSize(value string) (int, error) {
+	if value == "varint" {
+		return 0, nil
+	}
+	width, ok := intWidths[value]
+	if !ok || width.signed {
+		return 0, fmt.Errorf("bad len %q, want u8, u16, u32, u64 or varint", value)
+	}
+	return width.size, nil
+}
+
+// parseStructOptions разбирает опции после "// cgen: binpack": endian=big|little, len=u8..u64|varint для всех полей
+// и version=N - структура пишется с заголовком версии; template="..." - формат полей из шаблона pack perl
+func parseStructOptions(comment string) (structOptions, error) {
+	options := structOptions{Order: "LittleEndian", LenSize: 4}
+	rest := strings.TrimPrefix(comment, "// cgen: binpack")
+	// в шаблоне есть пробелы, поэтому он вырезается до разбора остальных опций
+	if before, after, found := strings.Cut(rest, `template="`); found {
+		template, tail, closed := strings.Cut(after, `"`)
+		if !closed {
+			return options, fmt.Errorf("template is not closed with \"")
+		}
+		items, err := parsePerlTemplate(template)
+		if err != nil {
+			return options, err
+		}
+		options.Template = items
+		rest = before + tail
+	}
+
+	for _, option := range strings.Fields(rest) {
+		if options.Template != nil {
+			// порядок байт и длины уже заданы шаблоном
+			return options, fmt.Errorf("template can't be combined with %q", option)
+		}
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "endian":
+			switch value {
+			case "little":
+				options.Order = "LittleEndian"
+			case "big":
+				options.Order = "BigEndian"
+			default:
+				return options, fmt.Errorf("bad endian %q, want little or big", value)
+			}
+		case "len":
+			size, err := parseLenSize(value)
+			if err != nil {
+				return options, err
+			}
+			options.LenSize = size
+		case "version":
+			version, err := strconv.Atoi(value)
+			if err != nil || version <= 0 {
+				return options, fmt.Errorf("bad version %q", value)
+			}
+			options.Version = version
+		default:
+			return options, fmt.Errorf("unknown binpack option %q", option)
+		}
+	}
+	return options, nil
+}
+
 func main() {
 	fset := token.NewFileSet()
 	node, err := parser.ParseFile(fset, os.Args[1], nil, parser.ParseComments)
@@ -43,14 +990,214 @@ func main() {
 		log.Fatal(err)
 	}
 
+	bt, order := collectTypes(node)
+	fields := map[string][]packField{}
+	for _, name := range order {
+		fields[name] = structFields(bt, name)
+	}
+
+	// схема рядом с результатом: pack/marshaller.go -> pack/marshaller.schema; проверяется до того,
+	// как перезаписан marshaller.go, чтобы несовместимое изменение ничего не испортило
+	schemaPath := strings.TrimSuffix(os.Args[2], ".go") + ".schema"
+	recorded, err := readSchema(schemaPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schema := buildSchema(bt, order, fields)
+	if errs := checkSchema(recorded, schema); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Println("schema:", err)
+		}
+		log.Fatalf("%d incompatible changes against %s", len(errs), schemaPath)
+	}
+	if err := writeSchema(schemaPath, schema); err != nil {
+		log.Fatal(err)
+	}
+
 	out, _ := os.Create(os.Args[2])
+	// круговые тесты кладутся рядом: pack/marshaller.go -> pack/marshaller_test.go
+	testOut, _ := os.Create(strings.TrimSuffix(os.Args[2], ".go") + "_test.go")
+	// импорты тестов зависят от того, какие тесты получились, поэтому сами тесты копятся отдельно
+	tests := &bytes.Buffer{}
+	withBinary, withStrings := false, false
 
 	fmt.Fprintln(out, `package `+node.Name.Name)
 	fmt.Fprintln(out) // empty line
-	fmt.Fprintln(out, `import "encoding/binary"`)
+	fmt.Fprintln(out, `import "bufio"`)
 	fmt.Fprintln(out, `import "bytes"`)
+	fmt.Fprintln(out, `import "encoding/binary"`)
+	fmt.Fprintln(out, `import "errors"`)
+	fmt.Fprintln(out, `import "fmt"`)
+	fmt.Fprintln(out, `import "io"`)
+	fmt.Fprintln(out, `import "math"`)
+	fmt.Fprintln(out, `import "unsafe"`)
+	errorsTpl.Execute(out, nil)
+	framesTpl.Execute(out, nil)
 	fmt.Fprintln(out) // empty line
 
+	for _, name := range order {
+		fmt.Printf("process struct %s\n", name)
+
+		if template, ok := bt.perlTemplate(fields, name); ok {
+			fmt.Fprintf(out, "// %sPackTemplate - тот же формат для pack и unpack в perl\n", name)
+			fmt.Fprintf(out, "const %sPackTemplate = %q\n", name, template)
+			fmt.Fprintln(out) // empty line
+		} else {
+			fmt.Printf("\tSKIP pack template: %s has varint, version or nested slices\n", name)
+		}
+		fmt.Printf("\tgenerating Unpack method\n")
+
+		fmt.Fprintln(out, "func (in *"+name+") Unpack(data []byte) error {")
+		fmt.Fprintln(out, "	d := newBinpackDecoder(data)")
+		fmt.Fprintln(out, "	in.decodeBinpack(d)")
+		fmt.Fprintln(out, "	return d.err")
+		fmt.Fprintln(out, "}") // end of Unpack func
+		fmt.Fprintln(out)      // empty line
+
+		fmt.Fprintln(out, "// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF")
+		fmt.Fprintln(out, "func (in *"+name+") DecodeFrom(r io.Reader) error {")
+		fmt.Fprintln(out, "	d := newBinpackStreamDecoder(r)")
+		fmt.Fprintln(out, "	in.decodeBinpack(d)")
+		fmt.Fprintln(out, "	return d.streamErr()")
+		fmt.Fprintln(out, "}") // end of DecodeFrom func
+		fmt.Fprintln(out)      // empty line
+
+		fmt.Fprintln(out, "func (in *"+name+") decodeBinpack(d *binpackDecoder) {")
+		options := bt.options[name]
+		if options.Version > 0 {
+			fmt.Fprintln(out, "	// заголовок версии")
+			fmt.Fprintf(out, "	d.begin(binary.%s)\n", options.Order)
+			if count := len(fields[name]); count > 0 && fields[name][count-1].Since > 1 {
+				fmt.Fprintln(out, "	version, outer := d.enter()")
+			} else {
+				fmt.Fprintln(out, "	_, outer := d.enter()")
+			}
+			fmt.Fprintf(out, "	if d.failed(%q, \"version\") {\n", name)
+			fmt.Fprintln(out, "		return")
+			fmt.Fprintln(out, "	}")
+		}
+		for i, field := range fields[name] {
+			fmt.Printf("\tgenerating code for field %s.%s\n", name, field.Name)
+
+			// в данных старой версии полей этой версии нет, они и все следующие обнуляются
+			if i > 0 && field.Since > fields[name][i-1].Since {
+				fmt.Fprintf(out, "	if version < %d {\n", field.Since)
+				fmt.Fprintln(out, "		var zero "+name)
+				for _, newer := range fields[name][i:] {
+					fmt.Fprintf(out, "		in.%s = zero.%s\n", newer.Name, newer.Name)
+				}
+				fmt.Fprintln(out, "		d.leave(outer)")
+				fmt.Fprintln(out, "		return")
+				fmt.Fprintln(out, "	}")
+			}
+
+			fmt.Fprintln(out, "	// "+field.Name)
+			fmt.Fprintf(out, "	d.begin(binary.%s)\n", field.Order)
+			fieldCodegen{out: out, field: field}.unpack("in."+field.Name, field.Wire, field.MaxLen, 1)
+			fmt.Fprintf(out, "	if d.failed(%q, %q) {\n", name, field.Name)
+			fmt.Fprintln(out, "		return")
+			fmt.Fprintln(out, "	}")
+		}
+		if options.Version > 0 {
+			fmt.Fprintln(out, "	d.leave(outer)")
+		}
+		fmt.Fprintln(out, "}") // end of decodeBinpack func
+		fmt.Fprintln(out)      // empty line
+
+		fmt.Printf("\tgenerating Pack methods\n")
+
+		fmt.Fprintln(out, "func (in *"+name+") Pack() ([]byte, error) {")
+		fmt.Fprintln(out, "	return in.AppendPack(nil)")
+		fmt.Fprintln(out, "}") // end of Pack func
+		fmt.Fprintln(out)      // empty line
+
+		fmt.Fprintln(out, "// AppendPack дописывает запакованную структуру в dst, как append")
+		fmt.Fprintln(out, "func (in *"+name+") AppendPack(dst []byte) ([]byte, error) {")
+		fmt.Fprintln(out, "	return in.appendBinpack(dst, len(dst))")
+		fmt.Fprintln(out, "}") // end of AppendPack func
+		fmt.Fprintln(out)      // empty line
+
+		fmt.Fprintln(out, "func (in *"+name+") EncodeTo(w io.Writer) error {")
+		fmt.Fprintln(out, "	data, err := in.Pack()")
+		fmt.Fprintln(out, "	if err != nil {")
+		fmt.Fprintln(out, "		return err")
+		fmt.Fprintln(out, "	}")
+		fmt.Fprintln(out, "	_, err = w.Write(data)")
+		fmt.Fprintln(out, "	return err")
+		fmt.Fprintln(out, "}") // end of EncodeTo func
+		fmt.Fprintln(out)      // empty line
+
+		// start - начало внешней структуры, от него считаются смещения в ошибках
+		fmt.Fprintln(out, "func (in *"+name+") appendBinpack(dst []byte, start int) ([]byte, error) {")
+		withErr := false
+		for _, field := range fields[name] {
+			withErr = withErr || field.Wire.hasStruct()
+		}
+		if withErr {
+			fmt.Fprintln(out, "	var err error")
+		}
+		if options.Version > 0 {
+			// длина тела известна только после упаковки полей, под неё оставляется место
+			fmt.Fprintln(out, "	// заголовок версии")
+			fmt.Fprintf(out, "	dst = binary.AppendUvarint(dst, %d)\n", options.Version)
+			fmt.Fprintln(out, "	body := len(dst) + 4")
+			fmt.Fprintln(out, "	dst = append(dst, 0, 0, 0, 0)")
+		}
+		for _, field := range fields[name] {
+			fmt.Fprintln(out, "	// "+field.Name)
+			fieldCodegen{out: out, field: field}.pack("in."+field.Name, field.Wire, field.MaxLen, 1)
+		}
+		if options.Version > 0 {
+			fmt.Fprintln(out, "	if uint64(len(dst)-body) > math.MaxUint32 {")
+			fmt.Fprintf(out, "		return dst[:start], &FieldError{Struct: %q, Field: \"version\", Offset: body - 4 - start, Err: ErrLengthTooLarge}\n", name)
+			fmt.Fprintln(out, "	}")
+			fmt.Fprintf(out, "	binary.%s.PutUint32(dst[body-4:], uint32(len(dst)-body))\n", options.Order)
+		}
+		fmt.Fprintln(out, "	return dst, nil")
+		fmt.Fprintln(out, "}") // end of appendBinpack func
+		fmt.Fprintln(out)      // empty line
+
+		test := testTpl{
+			StructName: name,
+			NoAlloc:    !(&wireType{Kind: "struct", GoType: name}).allocates(fields),
+			Version:    options.Version,
+			Order:      options.Order,
+		}
+		offset := bt.headerSize(name)
+		for i, field := range fields[name] {
+			value, size := bt.testValue(field.Wire, fields, field.Name, i+1)
+			test.Fields = append(test.Fields, testField{
+				FieldName: field.Name,
+				Value:     value,
+				MaxLen:    field.MaxLen,
+				Overlong:  overlong(field),
+				Patch:     lengthPatch(field, offset),
+				Offset:    offset,
+			})
+			if field.Since > 1 {
+				test.NewFields = append(test.NewFields, field.Name)
+			}
+			offset += size
+			withBinary = withBinary || strings.HasPrefix(lengthPatch(field, offset), "binary.")
+			withStrings = withStrings || field.MaxLen > 0 && field.Wire.Kind != "slice"
+		}
+		withBinary = withBinary || options.Version > 0
+		roundTripTestTpl.Execute(tests, test)
+	}
+
+	testHeaderTpl.Execute(testOut, struct {
+		Package     string
+		WithBinary  bool
+		WithStrings bool
+	}{node.Name.Name, withBinary, withStrings})
+	tests.WriteTo(testOut)
+}
+
+// collectTypes собирает именованные типы файла и структуры с // cgen: binpack в порядке объявления
+func collectTypes(node *ast.File) (binpackTypes, []string) {
+	bt := binpackTypes{specs: map[string]*ast.TypeSpec{}, structs: map[string]bool{}, options: map[string]structOptions{}}
+	order := []string{}
+
 	for _, f := range node.Decls {
 		g, ok := f.(*ast.GenDecl)
 		if !ok {
@@ -64,6 +1211,7 @@ func main() {
 				fmt.Printf("SKIP %T is not ast.TypeSpec\n", spec)
 				continue
 			}
+			bt.specs[currType.Name.Name] = currType
 
 			currStruct, ok := currType.Type.(*ast.StructType)
 			if !ok {
@@ -78,51 +1226,88 @@ func main() {
 
 			needCodegen := false
 			for _, comment := range g.Doc.List {
-				needCodegen = needCodegen || strings.HasPrefix(comment.Text, "// cgen: binpack")
+				if !strings.HasPrefix(comment.Text, "// cgen: binpack") {
+					continue
+				}
+				needCodegen = true
+				options, err := parseStructOptions(comment.Text)
+				if err != nil {
+					log.Fatalln(currType.Name.Name, err)
+				}
+				bt.options[currType.Name.Name] = options
 			}
 			if !needCodegen {
 				fmt.Printf("SKIP struct %#v doesnt have cgen mark\n", currType.Name.Name)
 				continue SPECS_LOOP
 			}
 
-			fmt.Printf("process struct %s\n", currType.Name.Name)
-			fmt.Printf("\tgenerating Unpack method\n")
+			bt.structs[currType.Name.Name] = true
+			order = append(order, currType.Name.Name)
+		}
+	}
+	return bt, order
+}
 
-			fmt.Fprintln(out, "func (in *"+currType.Name.Name+") Unpack(data []byte) error {")
-			fmt.Fprintln(out, "	r := bytes.NewReader(data)")
+// structFields - поля структуры в порядке формата, без cgen:"-"
+func structFields(bt binpackTypes, name string) []packField {
+	currStruct := bt.specs[name].Type.(*ast.StructType)
+	fields := make([]packField, 0, len(currStruct.Fields.List))
 
-		FIELDS_LOOP:
-			for _, field := range currStruct.Fields.List {
+	for _, field := range currStruct.Fields.List {
+		if len(field.Names) == 0 {
+			log.Fatalln(name, "embedded fields are unsupported:", types.ExprString(field.Type))
+		}
+		tag := ""
+		if field.Tag != nil {
+			tag = reflect.StructTag(field.Tag.Value[1 : len(field.Tag.Value)-1]).Get("cgen")
+		}
+		if tag == "-" {
+			continue
+		}
 
-				if field.Tag != nil {
-					tag := reflect.StructTag(field.Tag.Value[1 : len(field.Tag.Value)-1])
-					if tag.Get("cgen") == "-" {
-						continue FIELDS_LOOP
-					}
+		wire, err := bt.resolve(field.Type, types.ExprString(field.Type), 0)
+		if err != nil {
+			log.Fatalln(name, err)
+		}
+		options := bt.options[name]
+		for _, fieldName := range field.Names {
+			current := packField{StructName: name, Name: fieldName.Name, Wire: wire.clone(), Order: options.Order, Since: 1}
+			current.Wire.setLenSize(options.LenSize)
+			if options.Template != nil {
+				if len(fields) >= len(options.Template) {
+					log.Fatalln(name, "template has", len(options.Template), "items, fields are more")
 				}
-
-				fieldName := field.Names[0].Name
-				fileType := field.Type.(*ast.Ident).Name
-
-				fmt.Printf("\tgenerating code for field %s.%s\n", currType.Name.Name, fieldName)
-
-				switch fileType {
-				case "int":
-					intTpl.Execute(out, tpl{fieldName})
-				case "string":
-					strTpl.Execute(out, tpl{fieldName})
-				default:
-					log.Fatalln("unsupported", fileType)
+				if err := options.Template[len(fields)].apply(&current); err != nil {
+					log.Fatalln(name, err)
 				}
 			}
+			if _, err := parseFieldTag(&current, tag); err != nil {
+				log.Fatalln(name, err)
+			}
+			fields = append(fields, current)
+		}
+	}
 
-			fmt.Fprintln(out, "	return nil")
-			fmt.Fprintln(out, "}") // end of Unpack func
-			fmt.Fprintln(out)      // empty line
-
+	options := bt.options[name]
+	if options.Version > 0 && len(fields) == 0 {
+		log.Fatalf("%s: version=%d without fields to pack, a versioned struct needs at least one field", name, options.Version)
+	}
+	if options.Template != nil && len(fields) != len(options.Template) {
+		log.Fatalln(name, "template has", len(options.Template), "items for", len(fields), "fields")
+	}
+	// старая версия читается до первого нового поля, поэтому новые поля только в конце
+	for i, field := range fields {
+		switch {
+		case field.Since > 1 && options.Version == 0:
+			log.Fatalln(name, field.Name, "since needs version=N in // cgen: binpack")
+		case field.Since > options.Version && options.Version > 0:
+			log.Fatalln(name, field.Name, "since", field.Since, "is newer than version", options.Version)
+		case i > 0 && field.Since < fields[i-1].Since:
+			log.Fatalln(name, field.Name, "since", field.Since, "goes after since", fields[i-1].Since, "- new fields must be appended")
 		}
 	}
+	return fields
 }
 
 // go build gen/* && ./codegen.exe pack/unpack.go  pack/marshaller.go
-// go run pack/*
+// go run ./pack
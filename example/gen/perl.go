@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// perlItem - одна буква шаблона pack из perl: "V", "n", "a16", "v3", "N/a*", "V/n*"
+type perlItem struct {
+	Code byte
+	// Kind и Size - как у wireType: uint, int, float или string для "a"
+	Kind string
+	Size int
+	// Order - порядок байт, пусто у однобайтовых и у "a"
+	Order string
+	// Count - число после буквы, -1 - "*", 0 - без числа
+	Count int
+	// Len - префикс длины перед "/"
+	Len *perlItem
+}
+
+// perlCodes - буквы pack, которые binpack умеет читать; "родной" порядок байт perl считается
+// little endian, как на x86, для big endian есть n, N и модификатор ">"
+var perlCodes = map[byte]perlItem{
+	'c': {Kind: "int", Size: 1}, 'C': {Kind: "uint", Size: 1},
+	's': {Kind: "int", Size: 2, Order: "LittleEndian"}, 'S': {Kind: "uint", Size: 2, Order: "LittleEndian"},
+	'l': {Kind: "int", Size: 4, Order: "LittleEndian"}, 'L': {Kind: "uint", Size: 4, Order: "LittleEndian"},
+	'i': {Kind: "int", Size: 4, Order: "LittleEndian"}, 'I': {Kind: "uint", Size: 4, Order: "LittleEndian"},
+	'q': {Kind: "int", Size: 8, Order: "LittleEndian"}, 'Q': {Kind: "uint", Size: 8, Order: "LittleEndian"},
+	'n': {Kind: "uint", Size: 2, Order: "BigEndian"}, 'N': {Kind: "uint", Size: 4, Order: "BigEndian"},
+	'v': {Kind: "uint", Size: 2, Order: "LittleEndian"}, 'V': {Kind: "uint", Size: 4, Order: "LittleEndian"},
+	'f': {Kind: "float", Size: 4, Order: "LittleEndian"}, 'd': {Kind: "float", Size: 8, Order: "LittleEndian"},
+	'a': {Kind: "string"},
+}
+
+// parsePerlTemplate разбирает шаблон pack; пробелы между буквами, как и в perl, ничего не значат
+func parsePerlTemplate(template string) ([]perlItem, error) {
+	items := []perlItem{}
+	rest := template
+	for {
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return items, nil
+		}
+		item, tail, err := parsePerlItem(rest)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %v", template, err)
+		}
+		if tail = strings.TrimSpace(tail); strings.HasPrefix(tail, "/") {
+			if item.Kind == "string" || item.Kind == "float" || item.Count != 0 {
+				return nil, fmt.Errorf("template %q: length before / must be an integer without count", template)
+			}
+			length := item
+			if item, tail, err = parsePerlItem(strings.TrimSpace(tail[1:])); err != nil {
+				return nil, fmt.Errorf("template %q: %v", template, err)
+			}
+			if item.Count != -1 {
+				return nil, fmt.Errorf("template %q: %c after / needs *", template, item.Code)
+			}
+			item.Len = &length
+		} else if item.Count == -1 {
+			return nil, fmt.Errorf("template %q: %c* without length prefix is unsupported", template, item.Code)
+		}
+		items = append(items, item)
+		rest = tail
+	}
+}
+
+func parsePerlItem(text string) (perlItem, string, error) {
+	item, ok := perlCodes[text[0]]
+	if !ok {
+		return item, "", fmt.Errorf("unsupported code %q", text[0])
+	}
+	item.Code = text[0]
+	text = text[1:]
+
+	if text != "" && (text[0] == '<' || text[0] == '>') {
+		if item.Order == "" || strings.IndexByte("nNvV", item.Code) >= 0 {
+			return item, "", fmt.Errorf("%c does not take %c", item.Code, text[0])
+		}
+		item.Order = "LittleEndian"
+		if text[0] == '>' {
+			item.Order = "BigEndian"
+		}
+		text = text[1:]
+	}
+
+	switch {
+	case strings.HasPrefix(text, "*"):
+		item.Count, text = -1, text[1:]
+	case text != "" && text[0] >= '0' && text[0] <= '9':
+		end := 0
+		for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+			end++
+		}
+		item.Count, _ = strconv.Atoi(text[:end])
+		if item.Count == 0 {
+			return item, "", fmt.Errorf("%c0 is empty", item.Code)
+		}
+		text = text[end:]
+	}
+	if item.Code == 'a' && item.Count == 0 {
+		return item, "", fmt.Errorf("a needs a length or /a*")
+	}
+	return item, text, nil
+}
+
+// apply переносит формат из шаблона на поле; теги поля применяются после и могут его уточнить
+func (item perlItem) apply(field *packField) error {
+	wt := field.Wire
+	order := item.Order
+	if item.Len != nil {
+		if order != "" && item.Len.Order != "" && order != item.Len.Order {
+			return fmt.Errorf("%s: %c/%c mixes byte orders", field.Name, item.Len.Code, item.Code)
+		}
+		if order == "" {
+			order = item.Len.Order
+		}
+		if item.Len.Kind != "uint" {
+			return fmt.Errorf("%s: length %c must be unsigned", field.Name, item.Len.Code)
+		}
+	}
+	if order != "" {
+		field.Order = order
+	}
+
+	switch wt.Kind {
+	case "string", "bytes":
+		if item.Code != 'a' || item.Len == nil {
+			return fmt.Errorf("%s: %s needs a length prefix like L/a*", field.Name, wt.GoType)
+		}
+		wt.LenSize = item.Len.Size
+	case "slice":
+		if item.Len == nil || item.Code == 'a' {
+			return fmt.Errorf("%s: %s needs a count and an element like L/S*", field.Name, wt.GoType)
+		}
+		wt.LenSize = item.Len.Size
+		return item.applyScalar(field.Name, wt.Elem)
+	case "array":
+		if item.Len != nil || item.Count != wt.Len {
+			return fmt.Errorf("%s: %s needs %c%d", field.Name, wt.GoType, item.Code, wt.Len)
+		}
+		if wt.Elem.isByte() {
+			if item.Code != 'a' {
+				return fmt.Errorf("%s: %s needs a%d", field.Name, wt.GoType, wt.Len)
+			}
+			return nil
+		}
+		return item.applyScalar(field.Name, wt.Elem)
+	default:
+		if item.Len != nil || item.Count != 0 {
+			return fmt.Errorf("%s: %s takes a single %c", field.Name, wt.GoType, item.Code)
+		}
+		return item.applyScalar(field.Name, wt)
+	}
+	return nil
+}
+
+// applyScalar - число, bool или элемент массива и слайса
+func (item perlItem) applyScalar(name string, wt *wireType) error {
+	switch wt.Kind {
+	case "uint", "int":
+		if item.Kind != "uint" && item.Kind != "int" {
+			return fmt.Errorf("%s: %s can't be %c", name, wt.GoType, item.Code)
+		}
+		wt.setWidth(item.Size, item.Kind == "int")
+	case "bool":
+		if item.Code != 'C' && item.Code != 'c' {
+			return fmt.Errorf("%s: bool is C", name)
+		}
+	case "float":
+		if item.Kind != "float" || item.Size != wt.Size {
+			return fmt.Errorf("%s: %s is %s", name, wt.GoType, map[int]string{4: "f", 8: "d"}[wt.Size])
+		}
+	default:
+		return fmt.Errorf("%s: %s is unsupported in template", name, wt.GoType)
+	}
+	return nil
+}
+
+// perlTemplate - шаблон pack для структуры, false - формат на шаблон не ложится:
+// varint, структуры с версией, слайсы строк и структур
+func (bt binpackTypes) perlTemplate(fields map[string][]packField, name string) (string, bool) {
+	if bt.options[name].Version > 0 {
+		return "", false
+	}
+	items := make([]string, 0, len(fields[name]))
+	for _, field := range fields[name] {
+		item, ok := bt.perlField(fields, field.Wire, field.Order)
+		if !ok {
+			return "", false
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, " "), true
+}
+
+func (bt binpackTypes) perlField(fields map[string][]packField, wt *wireType, order string) (string, bool) {
+	switch wt.Kind {
+	case "string", "bytes":
+		length, ok := perlCode("uint", wt.LenSize, order)
+		return length + "/a*", ok
+	case "array":
+		if wt.Elem.isByte() {
+			return "a" + strconv.Itoa(wt.Len), true
+		}
+		elem, ok := bt.perlField(fields, wt.Elem, order)
+		if wt.Elem.Kind == "struct" {
+			elem = "(" + elem + ")"
+		}
+		return elem + strconv.Itoa(wt.Len), ok
+	case "slice":
+		length, ok := perlCode("uint", wt.LenSize, order)
+		if !ok || wt.Elem.Kind == "string" || wt.Elem.Kind == "bytes" || wt.Elem.Kind == "struct" || wt.Elem.Kind == "slice" || wt.Elem.Kind == "array" {
+			return "", false
+		}
+		elem, ok := bt.perlField(fields, wt.Elem, order)
+		return length + "/" + elem + "*", ok
+	case "struct":
+		return bt.perlTemplate(fields, wt.GoType)
+	case "bool":
+		return "C", true
+	case "float":
+		return perlCode("float", wt.Size, order)
+	}
+	if wt.Varint != "" {
+		return "", false
+	}
+	return perlCode(wt.Kind, wt.Size, order)
+}
+
+// perlCode - буква pack с явным порядком байт, чтобы шаблон не зависел от машины
+func perlCode(kind string, size int, order string) (string, bool) {
+	big := order == "BigEndian"
+	switch {
+	case size == 1 && kind == "uint":
+		return "C", true
+	case size == 1:
+		return "c", true
+	case size == 2 && kind == "uint" && big:
+		return "n", true
+	case size == 2 && kind == "uint":
+		return "v", true
+	case size == 4 && kind == "uint" && big:
+		return "N", true
+	case size == 4 && kind == "uint":
+		return "V", true
+	}
+	code := map[string]map[int]string{"uint": {8: "Q"}, "int": {2: "s", 4: "l", 8: "q"}, "float": {4: "f", 8: "d"}}[kind][size]
+	if code == "" {
+		return "", false
+	}
+	if big {
+		return code + ">", true
+	}
+	return code + "<", true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schemaStruct - как структура лежит в данных, записывается в файл схемы рядом с marshaller.go:
+//
+//	Profile endian=LittleEndian version=2
+//		ID varint u64
+//		Email string/u32 since=2
+//	LegacyEvent endian=LittleEndian
+//		Kind u16 endian=BigEndian
+//
+// порядок байт поля пишется, только если он не совпадает с порядком структуры - его задаёт шаблон perl;
+// по нему следующий запуск генератора проверяет, что уже записанные данные читаются как раньше
+type schemaStruct struct {
+	Name    string
+	Order   string
+	Version int
+	Fields  []schemaField
+}
+
+type schemaField struct {
+	Name      string
+	Signature string
+	Order     string
+	Since     int
+}
+
+// signature - формат поля в данных без имён типов Go: int и int64 в 8 байтах - одно и то же
+func (wt *wireType) signature() string {
+	switch wt.Kind {
+	case "uint", "int":
+		name := "u" + strconv.Itoa(wt.Size*8)
+		if wt.Kind == "int" {
+			name = "i" + strconv.Itoa(wt.Size*8)
+		}
+		switch wt.Varint {
+		case "varint":
+			return "varint " + name
+		case "zigzag":
+			return "zigzag"
+		}
+		return name
+	case "bool":
+		return "bool"
+	case "float":
+		return "f" + strconv.Itoa(wt.Size*8)
+	case "string", "bytes":
+		return wt.Kind + "/" + wt.lenSignature()
+	case "array":
+		return "[" + strconv.Itoa(wt.Len) + "]" + wt.Elem.signature()
+	case "slice":
+		return "[" + wt.lenSignature() + "]" + wt.Elem.signature()
+	}
+	// вложенная структура проверяется своей записью в схеме
+	return wt.GoType
+}
+
+func (wt *wireType) lenSignature() string {
+	if wt.LenSize == 0 {
+		return "varint"
+	}
+	return "u" + strconv.Itoa(wt.LenSize*8)
+}
+
+func buildSchema(bt binpackTypes, order []string, fields map[string][]packField) []schemaStruct {
+	schema := make([]schemaStruct, 0, len(order))
+	for _, name := range order {
+		current := schemaStruct{Name: name, Order: bt.options[name].Order, Version: bt.options[name].Version}
+		for _, field := range fields[name] {
+			current.Fields = append(current.Fields, schemaField{Name: field.Name, Signature: field.Wire.signature(), Order: field.Order, Since: field.Since})
+		}
+		schema = append(schema, current)
+	}
+	return schema
+}
+
+// readSchema читает файл схемы, нет файла - нет и схемы, проверять не с чем
+func readSchema(path string) (map[string]schemaStruct, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	schema := map[string]schemaStruct{}
+	var current *schemaStruct
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "\t") {
+			if current == nil {
+				return nil, fmt.Errorf("%s:%d: field outside of struct", path, line)
+			}
+			name, signature, _ := strings.Cut(strings.TrimSpace(text), " ")
+			field := schemaField{Name: name, Signature: signature, Order: current.Order, Since: 1}
+			if rest, since, ok := strings.Cut(field.Signature, " since="); ok {
+				field.Signature = rest
+				if field.Since, err = strconv.Atoi(since); err != nil {
+					return nil, fmt.Errorf("%s:%d: bad since %q", path, line, since)
+				}
+			}
+			if rest, order, ok := strings.Cut(field.Signature, " endian="); ok {
+				field.Signature, field.Order = rest, order
+			}
+			current.Fields = append(current.Fields, field)
+			continue
+		}
+
+		words := strings.Fields(text)
+		if current != nil {
+			schema[current.Name] = *current
+		}
+		current = &schemaStruct{Name: words[0]}
+		for _, word := range words[1:] {
+			name, value, _ := strings.Cut(word, "=")
+			switch name {
+			case "endian":
+				current.Order = value
+			case "version":
+				if current.Version, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: bad version %q", path, line, value)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown option %q", path, line, word)
+			}
+		}
+	}
+	if current != nil {
+		schema[current.Name] = *current
+	}
+	return schema, scanner.Err()
+}
+
+// checkSchema сравнивает новую схему с записанной: поля нельзя удалять, переставлять
+// и менять их формат, порядок байт тоже менять нельзя; у версионной структуры новые поля
+// должны быть новее записанной версии, иначе старые данные прочитаются неправильно.
+// Структура без версии не расширяется вовсе, а заголовок версии нельзя ни добавить, ни убрать -
+// в обоих случаях старые данные перестают читаться
+func checkSchema(recorded map[string]schemaStruct, schema []schemaStruct) []error {
+	errs := []error{}
+
+	// пропавшая структура молча выпала бы из схемы, и её данные потом никто бы не проверил
+	present := map[string]bool{}
+	for _, current := range schema {
+		present[current.Name] = true
+	}
+	missing := []string{}
+	for name := range recorded {
+		if !present[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		errs = append(errs, fmt.Errorf("%s: struct removed or lost cgen: binpack, its data is still in the schema", name))
+	}
+
+	for _, current := range schema {
+		old, ok := recorded[current.Name]
+		if !ok {
+			continue
+		}
+		if old.Order != current.Order {
+			errs = append(errs, fmt.Errorf("%s: byte order changed from %s to %s", current.Name, old.Order, current.Order))
+		}
+		if current.Version > 0 && current.Version < old.Version {
+			errs = append(errs, fmt.Errorf("%s: version went down from %d to %d", current.Name, old.Version, current.Version))
+		}
+		if old.Version > 0 && current.Version == 0 {
+			errs = append(errs, fmt.Errorf("%s: version header removed", current.Name))
+		}
+		if old.Version == 0 && current.Version > 0 {
+			errs = append(errs, fmt.Errorf("%s: version header added, data without it is already written", current.Name))
+		}
+
+		for i, oldField := range old.Fields {
+			if i >= len(current.Fields) {
+				errs = append(errs, fmt.Errorf("%s.%s: field removed", current.Name, oldField.Name))
+				continue
+			}
+			field := current.Fields[i]
+			switch {
+			case field.Name != oldField.Name:
+				errs = append(errs, fmt.Errorf("%s: field %d is %s, was %s - fields can only be appended", current.Name, i, field.Name, oldField.Name))
+			case field.Signature != oldField.Signature:
+				errs = append(errs, fmt.Errorf("%s.%s: format changed from %q to %q", current.Name, field.Name, oldField.Signature, field.Signature))
+			case field.Order != oldField.Order && old.Order == current.Order:
+				errs = append(errs, fmt.Errorf("%s.%s: byte order changed from %s to %s", current.Name, field.Name, oldField.Order, field.Order))
+			case field.Since != oldField.Since:
+				errs = append(errs, fmt.Errorf("%s.%s: since changed from %d to %d", current.Name, field.Name, oldField.Since, field.Since))
+			}
+		}
+
+		if len(current.Fields) <= len(old.Fields) {
+			continue
+		}
+		for _, field := range current.Fields[len(old.Fields):] {
+			switch {
+			case old.Version == 0:
+				errs = append(errs, fmt.Errorf("%s.%s: new field in a struct without version, old data ends before it", current.Name, field.Name))
+			case field.Since <= old.Version:
+				errs = append(errs, fmt.Errorf("%s.%s: new field needs since=%d or newer, data of version %d is already written", current.Name, field.Name, old.Version+1, old.Version))
+			}
+		}
+	}
+	return errs
+}
+
+func writeSchema(path string, schema []schemaStruct) error {
+	out := &strings.Builder{}
+	fmt.Fprintln(out, "# схема binpack: генератор не даст изменить то, что сломает уже записанные данные")
+	fmt.Fprintln(out, "# удалять файл можно, только если старые данные больше не нужны")
+	for _, current := range schema {
+		fmt.Fprintln(out) // empty line
+		fmt.Fprintf(out, "%s endian=%s", current.Name, current.Order)
+		if current.Version > 0 {
+			fmt.Fprintf(out, " version=%d", current.Version)
+		}
+		fmt.Fprintln(out)
+		for _, field := range current.Fields {
+			fmt.Fprintf(out, "\t%s %s", field.Name, field.Signature)
+			if field.Order != current.Order {
+				fmt.Fprintf(out, " endian=%s", field.Order)
+			}
+			if field.Since > 1 {
+				fmt.Fprintf(out, " since=%d", field.Since)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	return os.WriteFile(path, []byte(out.String()), 0644)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const schemaBaseSrc = `package pack
+
+// cgen: binpack len=varint
+type Counters struct {
+	Hits uint64 ` + "`cgen:\"varint\"`" + `
+	Name string
+}
+
+// cgen: binpack version=2
+type Profile struct {
+	ID    uint64
+	Email string ` + "`cgen:\"since=2\"`" + `
+}
+
+// cgen: binpack template="n N/a*"
+type Legacy struct {
+	Kind    uint16
+	Payload []byte
+}
+`
+
+// schemaOf проходит тот же путь, что и запуск генератора: разбор файла, поля, схема
+func schemaOf(t *testing.T, src string) []schemaStruct {
+	t.Helper()
+	node, err := parser.ParseFile(token.NewFileSet(), "unpack.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	bt, order := collectTypes(node)
+	fields := map[string][]packField{}
+	for _, name := range order {
+		fields[name] = structFields(bt, name)
+	}
+	return buildSchema(bt, order, fields)
+}
+
+func TestCheckSchema(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "marshaller.schema")
+	if err := writeSchema(schemaPath, schemaOf(t, schemaBaseSrc)); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := readSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name   string
+		Old    string
+		New    string
+		Errors []string
+	}{
+		{
+			Name: "unchanged",
+		},
+		{
+			Name: "new field in versioned struct",
+			Old:  "version=2\ntype Profile struct {\n\tID    uint64\n\tEmail string `cgen:\"since=2\"`\n",
+			New:  "version=3\ntype Profile struct {\n\tID    uint64\n\tEmail string `cgen:\"since=2\"`\n\tPhone string `cgen:\"since=3\"`\n",
+		},
+		{
+			Name:   "new field in struct without version",
+			Old:    "\tName string\n",
+			New:    "\tName string\n\tLevel int32\n",
+			Errors: []string{"Counters.Level: new field in a struct without version, old data ends before it"},
+		},
+		{
+			Name:   "version header added",
+			Old:    "// cgen: binpack len=varint\n",
+			New:    "// cgen: binpack len=varint version=1\n",
+			Errors: []string{"Counters: version header added, data without it is already written"},
+		},
+		{
+			Name:   "version header removed",
+			Old:    "// cgen: binpack version=2\ntype Profile struct {\n\tID    uint64\n\tEmail string `cgen:\"since=2\"`\n",
+			New:    "// cgen: binpack\ntype Profile struct {\n\tID    uint64\n\tEmail string\n",
+			Errors: []string{"Profile: version header removed", "Profile.Email: since changed from 2 to 1"},
+		},
+		{
+			Name:   "struct removed",
+			Old:    "// cgen: binpack version=2\n",
+			New:    "// version=2\n",
+			Errors: []string{"Profile: struct removed or lost cgen: binpack, its data is still in the schema"},
+		},
+		{
+			Name:   "new field of recorded version",
+			Old:    "\tEmail string `cgen:\"since=2\"`\n",
+			New:    "\tEmail string `cgen:\"since=2\"`\n\tPhone string `cgen:\"since=2\"`\n",
+			Errors: []string{"Profile.Phone: new field needs since=3 or newer, data of version 2 is already written"},
+		},
+		{
+			Name:   "byte order from template",
+			Old:    `template="n N/a*"`,
+			New:    `template="v N/a*"`,
+			Errors: []string{"Legacy.Kind: byte order changed from BigEndian to LittleEndian"},
+		},
+	}
+
+	for _, item := range cases {
+		src := strings.Replace(schemaBaseSrc, item.Old, item.New, 1)
+		if src == schemaBaseSrc && item.Old != "" {
+			t.Fatalf("%s: %q not found in source", item.Name, item.Old)
+		}
+		errs := checkSchema(recorded, schemaOf(t, src))
+
+		got := make([]string, 0, len(errs))
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(item.Errors, "\n") {
+			t.Errorf("%s:\nwant %q\ngot  %q", item.Name, item.Errors, got)
+		}
+	}
+}
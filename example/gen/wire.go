@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// wireType - как значение лежит в бинарном формате
+type wireType struct {
+	// Kind: uint, int, bool, float, string, bytes, array, slice, struct
+	Kind string
+	// Size - ширина чисел в байтах
+	Size int
+	// GoType - тип в исходнике, в него приводится прочитанное значение
+	GoType string
+	// GoSize и GoSigned - ширина и знак целого в Go, int и uint лежат в 4 байтах и требуют проверки диапазона
+	GoSize   int
+	GoSigned bool
+	// Len - длина массива
+	Len int
+	// LenSize - ширина префикса длины у строк, []byte и слайсов, 0 - varint
+	LenSize int
+	// Varint - целое пишется как varint (LEB128, как в protobuf) или zigzag, пусто - фиксированной ширины
+	Varint string
+	// NoAlloc - строки и []byte ссылаются на данные Unpack без копирования, cgen:"noalloc"
+	NoAlloc bool
+	Elem    *wireType
+}
+
+// binpackTypes - типы из разбираемого файла: именованные типы и структуры с // cgen: binpack
+type binpackTypes struct {
+	specs   map[string]*ast.TypeSpec
+	structs map[string]bool
+	options map[string]structOptions
+}
+
+var fixedInts = map[string]struct {
+	size   int
+	signed bool
+}{
+	"int8": {1, true}, "int16": {2, true}, "int32": {4, true}, "int64": {8, true},
+	"uint8": {1, false}, "uint16": {2, false}, "uint32": {4, false}, "uint64": {8, false},
+	"byte": {1, false}, "rune": {4, true},
+}
+
+// resolve строит wireType по типу поля, goType - как тип записан в исходнике
+func (bt binpackTypes) resolve(expr ast.Expr, goType string, depth int) (*wireType, error) {
+	if depth > 16 {
+		return nil, fmt.Errorf("type %s is too deep", goType)
+	}
+
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if fixed, ok := fixedInts[t.Name]; ok {
+			kind := "uint"
+			if fixed.signed {
+				kind = "int"
+			}
+			return &wireType{Kind: kind, Size: fixed.size, GoType: goType, GoSize: fixed.size, GoSigned: fixed.signed}, nil
+		}
+		switch t.Name {
+		case "int", "uint":
+			// исторически int пишется как беззнаковые 4 байта, как L у perl
+			return &wireType{Kind: "uint", Size: 4, GoType: goType, GoSize: 8, GoSigned: t.Name == "int"}, nil
+		case "bool":
+			return &wireType{Kind: "bool", Size: 1, GoType: goType}, nil
+		case "float32":
+			return &wireType{Kind: "float", Size: 4, GoType: goType}, nil
+		case "float64":
+			return &wireType{Kind: "float", Size: 8, GoType: goType}, nil
+		case "string":
+			return &wireType{Kind: "string", GoType: goType, LenSize: 4}, nil
+		}
+
+		spec, ok := bt.specs[t.Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported %s", t.Name)
+		}
+		if _, isStruct := spec.Type.(*ast.StructType); isStruct {
+			if !bt.structs[t.Name] {
+				return nil, fmt.Errorf("nested struct %s must be marked with // cgen: binpack", t.Name)
+			}
+			return &wireType{Kind: "struct", GoType: goType}, nil
+		}
+		// именованный тип кодируется как его основа, но приводится к своему имени
+		return bt.resolve(spec.Type, goType, depth+1)
+
+	case *ast.ArrayType:
+		elem, err := bt.resolve(t.Elt, types.ExprString(t.Elt), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if t.Len == nil {
+			if elem.isByte() {
+				return &wireType{Kind: "bytes", GoType: goType, LenSize: 4}, nil
+			}
+			return &wireType{Kind: "slice", GoType: goType, LenSize: 4, Elem: elem}, nil
+		}
+		lit, ok := t.Len.(*ast.BasicLit)
+		if !ok {
+			return nil, fmt.Errorf("array length of %s must be a number", goType)
+		}
+		length, err := strconv.Atoi(lit.Value)
+		if err != nil {
+			return nil, fmt.Errorf("bad array length of %s: %v", goType, err)
+		}
+		return &wireType{Kind: "array", GoType: goType, Len: length, Elem: elem}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported %s", goType)
+}
+
+// intWidths - ширины целых для тегов cgen:"u16" и cgen:"len=u8"
+var intWidths = map[string]struct {
+	size   int
+	signed bool
+}{
+	"u8": {1, false}, "u16": {2, false}, "u32": {4, false}, "u64": {8, false},
+	"i8": {1, true}, "i16": {2, true}, "i32": {4, true}, "i64": {8, true},
+}
+
+// clone нужен, потому что у полей `A, B int` тип общий, а теги меняют его по месту
+func (wt *wireType) clone() *wireType {
+	copied := *wt
+	if wt.Elem != nil {
+		copied.Elem = wt.Elem.clone()
+	}
+	return &copied
+}
+
+// setWidth меняет ширину целых внутри поля, включая элементы массивов и слайсов;
+// вложенные структуры описывают себя сами
+func (wt *wireType) setWidth(size int, signed bool) bool {
+	switch wt.Kind {
+	case "uint", "int":
+		wt.Size = size
+		wt.Kind = "uint"
+		if signed {
+			wt.Kind = "int"
+		}
+		return true
+	case "array", "slice":
+		return wt.Elem.setWidth(size, signed)
+	}
+	return false
+}
+
+// setVarint делает целые внутри поля varint или zigzag; varint знакового целого,
+// как int32 в protobuf, пишет отрицательные числа в 10 байт, zigzag - в несколько
+func (wt *wireType) setVarint(encoding string) bool {
+	switch wt.Kind {
+	case "uint", "int":
+		wt.Varint, wt.Size = encoding, 8
+		if encoding == "zigzag" {
+			wt.Kind = "int"
+		}
+		return true
+	case "array", "slice":
+		return !wt.Elem.isByte() && wt.Elem.setVarint(encoding)
+	}
+	return false
+}
+
+// setLenSize меняет ширину всех префиксов длины внутри поля
+func (wt *wireType) setLenSize(size int) bool {
+	found := false
+	switch wt.Kind {
+	case "string", "bytes":
+		wt.LenSize, found = size, true
+	case "slice":
+		wt.LenSize, found = size, true
+		wt.Elem.setLenSize(size)
+	case "array":
+		found = wt.Elem.setLenSize(size)
+	}
+	return found
+}
+
+// setNoAlloc включает cgen:"noalloc" у строк и []byte внутри поля
+func (wt *wireType) setNoAlloc() bool {
+	switch wt.Kind {
+	case "string", "bytes":
+		wt.NoAlloc = true
+		return true
+	case "array", "slice":
+		return wt.Elem.setNoAlloc()
+	}
+	return false
+}
+
+// allocates - выделяет ли Unpack память под поле; у вложенных структур смотрятся их поля
+func (wt *wireType) allocates(fields map[string][]packField) bool {
+	switch wt.Kind {
+	case "string", "bytes":
+		return !wt.NoAlloc
+	case "slice":
+		return true
+	case "array":
+		return wt.Elem.allocates(fields)
+	case "struct":
+		for _, field := range fields[wt.GoType] {
+			if field.Wire.allocates(fields) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fitsLen - помещается ли длина n в префикс длины
+func (wt *wireType) fitsLen(n uint64) bool {
+	return wt.LenSize == 0 || wt.LenSize == 8 || n < 1<<(8*wt.LenSize)
+}
+
+// lenBytes - сколько байт займёт префикс длины n
+func (wt *wireType) lenBytes(n int) int {
+	if wt.LenSize == 0 {
+		return len(binary.AppendUvarint(nil, uint64(n)))
+	}
+	return wt.LenSize
+}
+
+// isByte - []byte и [N]byte пишутся как есть, без поэлементного цикла
+func (wt *wireType) isByte() bool {
+	return wt.GoType == "byte" || wt.GoType == "uint8"
+}
+
+func (wt *wireType) uintName() string {
+	return "uint" + strconv.Itoa(wt.Size*8)
+}
+
+func (wt *wireType) intName() string {
+	return "int" + strconv.Itoa(wt.Size*8)
+}
+
+// convert приводит выражение к типу поля, если это не тот же самый тип
+func (wt *wireType) convert(expr, exprType string) string {
+	if wt.GoType == exprType {
+		return expr
+	}
+	return wt.GoType + "(" + expr + ")"
+}
+
+// rangeCheck - условие, при котором целое из Go не помещается в поле формата, пусто - всегда помещается
+func (wt *wireType) rangeCheck(v string) string {
+	if wt.GoSize <= wt.Size && wt.GoSigned == (wt.Kind == "int") {
+		return ""
+	}
+	bits := strconv.Itoa(wt.Size * 8)
+	switch {
+	case wt.Kind == "uint" && wt.GoSigned && wt.Size == 8:
+		return fmt.Sprintf("int64(%s) < 0", v)
+	case wt.Kind == "uint" && wt.GoSigned:
+		return fmt.Sprintf("int64(%s) < 0 || uint64(%s) > math.MaxUint%s", v, v, bits)
+	case wt.Kind == "uint":
+		return fmt.Sprintf("uint64(%s) > math.MaxUint%s", v, bits)
+	case wt.GoSigned:
+		return fmt.Sprintf("int64(%s) < math.MinInt%s || int64(%s) > math.MaxInt%s", v, bits, v, bits)
+	default:
+		return fmt.Sprintf("uint64(%s) > math.MaxInt%s", v, bits)
+	}
+}
+
+// fieldCodegen пишет код упаковки и распаковки одного поля, вложенные типы разворачиваются рекурсивно
+type fieldCodegen struct {
+	out   io.Writer
+	field packField
+}
+
+func (fc fieldCodegen) line(depth int, format string, args ...interface{}) {
+	fmt.Fprintf(fc.out, strings.Repeat("\t", depth)+format+"\n", args...)
+}
+
+// unpack читает значение в target; ошибки копятся в декодере и проверяются после поля
+func (fc fieldCodegen) unpack(target string, wt *wireType, maxLen, depth int) {
+	index := "i" + strconv.Itoa(depth-1)
+
+	switch wt.Kind {
+	case "uint", "int":
+		raw := "d." + wt.uintName() + "()"
+		if wt.Varint != "" {
+			raw = "d." + wt.Varint + "()"
+		}
+		fc.line(depth, "%s = %s", target, wt.decodeInt(raw))
+	case "bool":
+		fc.line(depth, "%s = %s", target, wt.convert("d.bool()", "bool"))
+	case "float":
+		name := "float" + strconv.Itoa(wt.Size*8)
+		fc.line(depth, "%s = %s", target, wt.convert("d."+name+"()", name))
+	case "string":
+		read := "d.string"
+		if wt.NoAlloc {
+			read = "d.aliasString"
+		}
+		fc.line(depth, "%s = %s", target, wt.convert(read+"("+wt.lengthExpr(maxLen)+")", "string"))
+	case "bytes":
+		read := "d.bytes"
+		if wt.NoAlloc {
+			read = "d.alias"
+		}
+		fc.line(depth, "%s = %s", target, wt.convert(read+"("+wt.lengthExpr(maxLen)+")", "[]byte"))
+	case "array":
+		if wt.Elem.isByte() {
+			fc.line(depth, "d.fill(%s[:])", target)
+			return
+		}
+		fc.line(depth, "for %s := range %s {", index, target)
+		fc.unpack(target+"["+index+"]", wt.Elem, 0, depth+1)
+		fc.line(depth, "}")
+	case "slice":
+		count := "n" + strconv.Itoa(depth-1)
+		item := "v" + strconv.Itoa(depth-1)
+		fc.line(depth, "%s = nil", target)
+		fc.line(depth, "if %s := %s; %s > 0 {", count, wt.lengthExpr(maxLen), count)
+		// в потоке длина не проверена данными, поэтому слайс растёт по мере чтения
+		fc.line(depth+1, "%s = make(%s, 0, d.capacity(%s))", target, wt.GoType, count)
+		fc.line(depth+1, "for %s := 0; %s < %s && d.err == nil; %s++ {", index, index, count, index)
+		fc.line(depth+2, "var %s %s", item, wt.Elem.GoType)
+		fc.unpack(item, wt.Elem, 0, depth+2)
+		fc.line(depth+2, "%s = append(%s, %s)", target, target, item)
+		fc.line(depth+1, "}")
+		fc.line(depth, "}")
+	case "struct":
+		fc.line(depth, "%s.decodeBinpack(d)", target)
+	}
+}
+
+// decodeInt приводит прочитанное целое к типу поля; если в поле формата помещается больше,
+// чем в тип Go, значение проверяется и при переполнении декодер получает ErrOutOfRange
+func (wt *wireType) decodeInt(raw string) string {
+	wireSigned := wt.Kind == "int"
+	if wireSigned {
+		raw = wt.intName() + "(" + raw + ")"
+	}
+	// 8-байтовое поле уже прочитано как uint64 или int64
+	wide := raw
+	if wt.Size < 8 {
+		wide = "int64(" + raw + ")"
+		if !wireSigned {
+			wide = "uint64(" + raw + ")"
+		}
+	}
+	goBits := strconv.Itoa(wt.GoSize * 8)
+	goMax := "math.MaxUint" + goBits
+	if wt.GoSigned {
+		goMax = "math.MaxInt" + goBits
+	}
+
+	switch {
+	case !wireSigned && (wt.Size > wt.GoSize || wt.Size == wt.GoSize && wt.GoSigned):
+		return wt.GoType + "(d.checkUint(" + wide + ", " + goMax + "))"
+	case wireSigned && !wt.GoSigned:
+		if wt.GoSize == 8 {
+			goMax = "math.MaxInt64"
+		}
+		return wt.GoType + "(d.checkInt(" + wide + ", 0, " + goMax + "))"
+	case wireSigned && wt.Size > wt.GoSize:
+		return wt.GoType + "(d.checkInt(" + wide + ", math.MinInt" + goBits + ", " + goMax + "))"
+	}
+	if wireSigned {
+		return wt.convert(raw, wt.intName())
+	}
+	return wt.convert(raw, wt.uintName())
+}
+
+// lengthExpr читает префикс длины нужной ширины
+func (wt *wireType) lengthExpr(maxLen int) string {
+	if wt.LenSize == 0 {
+		return fmt.Sprintf("d.length(d.varint(), %d)", maxLen)
+	}
+	return fmt.Sprintf("d.length(uint64(d.uint%d()), %d)", wt.LenSize*8, maxLen)
+}
+
+// pack дописывает value в dst; при ошибке dst обрезается до начала структуры
+func (fc fieldCodegen) pack(value string, wt *wireType, maxLen, depth int) {
+	index := "i" + strconv.Itoa(depth-1)
+	fail := func(err string) {
+		fc.line(depth+1, "return dst[:start], &FieldError{Struct: %q, Field: %q, Offset: len(dst) - start, Err: %s}", fc.field.StructName, fc.field.Name, err)
+		fc.line(depth, "}")
+	}
+	order := "binary." + fc.field.Order
+	appendUint := func(size int, v string) {
+		if size == 1 {
+			fc.line(depth, "dst = append(dst, byte(%s))", v)
+		} else {
+			fc.line(depth, "dst = %s.AppendUint%d(dst, uint%d(%s))", order, size*8, size*8, v)
+		}
+	}
+	lengthCheck := func() {
+		switch {
+		case maxLen > 0:
+			fc.line(depth, "if len(%s) > %d {", value, maxLen)
+			fail("ErrLengthTooLarge")
+		case wt.LenSize > 0 && wt.LenSize < 8:
+			fc.line(depth, "if uint64(len(%s)) > math.MaxUint%d {", value, wt.LenSize*8)
+			fail("ErrLengthTooLarge")
+		}
+		if wt.LenSize == 0 {
+			fc.line(depth, "dst = binary.AppendUvarint(dst, uint64(len(%s)))", value)
+		} else {
+			appendUint(wt.LenSize, "len("+value+")")
+		}
+	}
+
+	switch wt.Kind {
+	case "uint", "int":
+		if check := wt.rangeCheck(value); check != "" {
+			fc.line(depth, "if %s {", check)
+			fail("ErrOutOfRange")
+		}
+		switch wt.Varint {
+		case "varint":
+			fc.line(depth, "dst = binary.AppendUvarint(dst, uint64(%s))", value)
+		case "zigzag":
+			fc.line(depth, "dst = binary.AppendVarint(dst, int64(%s))", value)
+		default:
+			appendUint(wt.Size, value)
+		}
+	case "bool":
+		fc.line(depth, "dst = append(dst, binpackBool(bool(%s)))", value)
+	case "float":
+		bits := strconv.Itoa(wt.Size * 8)
+		fc.line(depth, "dst = %s.AppendUint%s(dst, math.Float%sbits(float%s(%s)))", order, bits, bits, bits, value)
+	case "string", "bytes":
+		lengthCheck()
+		fc.line(depth, "dst = append(dst, %s...)", value)
+	case "array":
+		if wt.Elem.isByte() {
+			fc.line(depth, "dst = append(dst, %s[:]...)", value)
+			return
+		}
+		fc.line(depth, "for %s := range %s {", index, value)
+		fc.pack(value+"["+index+"]", wt.Elem, 0, depth+1)
+		fc.line(depth, "}")
+	case "slice":
+		lengthCheck()
+		fc.line(depth, "for %s := range %s {", index, value)
+		fc.pack(value+"["+index+"]", wt.Elem, 0, depth+1)
+		fc.line(depth, "}")
+	case "struct":
+		fc.line(depth, "if dst, err = %s.appendBinpack(dst, start); err != nil {", value)
+		fc.line(depth+1, "return dst, err")
+		fc.line(depth, "}")
+	}
+}
+
+// hasStruct - нужна ли в AppendPack переменная err для вложенных структур
+func (wt *wireType) hasStruct() bool {
+	return wt.Kind == "struct" || wt.Elem != nil && wt.Elem.hasStruct()
+}
+
+// testValue - значение для круговых тестов и его размер в запакованном виде,
+// у каждого поля своё значение, чтобы поймать перепутанный порядок
+func (bt binpackTypes) testValue(wt *wireType, fields map[string][]packField, name string, seed int) (string, int) {
+	switch wt.Kind {
+	case "uint", "int":
+		// значение должно помещаться и в поле формата, и в тип Go
+		size := wt.Size
+		if wt.GoSize < size {
+			size = wt.GoSize
+		}
+		value := [...]int64{0, 100, 30000, 1000000000, 1 << 40}[bitsIndex(size)] + int64(seed)
+		if wt.GoSize == 8 && wt.Size == 4 && wt.Kind == "uint" {
+			value = 1000003 * int64(seed)
+		}
+		if wt.Kind == "int" && wt.GoSigned && seed%2 == 0 {
+			value = -value
+		}
+		switch wt.Varint {
+		case "varint":
+			return strconv.FormatInt(value, 10), len(binary.AppendUvarint(nil, uint64(value)))
+		case "zigzag":
+			return strconv.FormatInt(value, 10), len(binary.AppendVarint(nil, value))
+		}
+		return strconv.FormatInt(value, 10), wt.Size
+	case "bool":
+		return strconv.FormatBool(seed%2 == 1), 1
+	case "float":
+		return strconv.Itoa(seed) + ".5", wt.Size
+	case "string":
+		value := name + " value"
+		return strconv.Quote(value), wt.lenBytes(len(value)) + len(value)
+	case "bytes":
+		value := name + " bytes"
+		return wt.GoType + "(" + strconv.Quote(value) + ")", wt.lenBytes(len(value)) + len(value)
+	case "array", "slice":
+		count, size := wt.Len, 0
+		if wt.Kind == "slice" {
+			count, size = 2, wt.lenBytes(2)
+		}
+		items := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			item, itemSize := bt.testValue(wt.Elem, fields, fmt.Sprintf("%s[%d]", name, i), seed+i+1)
+			items = append(items, item)
+			size += itemSize
+		}
+		return wt.GoType + "{" + strings.Join(items, ", ") + "}", size
+	case "struct":
+		items := make([]string, 0, len(fields[wt.GoType]))
+		size := bt.headerSize(wt.GoType)
+		for i, field := range fields[wt.GoType] {
+			item, itemSize := bt.testValue(field.Wire, fields, name+"."+field.Name, seed+i+1)
+			items = append(items, field.Name+": "+item)
+			size += itemSize
+		}
+		return wt.GoType + "{" + strings.Join(items, ", ") + "}", size
+	}
+	return "", 0
+}
+
+// headerSize - размер заголовка версии: версия varint и длина тела uint32
+func (bt binpackTypes) headerSize(name string) int {
+	if version := bt.options[name].Version; version > 0 {
+		return len(binary.AppendUvarint(nil, uint64(version))) + 4
+	}
+	return 0
+}
+
+func bitsIndex(size int) int {
+	switch size {
+	case 1:
+		return 1
+	case 2:
+		return 2
+	case 4:
+		return 3
+	}
+	return 4
+}
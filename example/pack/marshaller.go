@@ -1,26 +1,1322 @@
 package main
 
-import "encoding/binary"
+import "bufio"
 import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "unsafe"
+
+var (
+	// ErrShortBuffer - данные закончились раньше, чем структура
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrLengthTooLarge - длина строки больше maxlen из тега или больше, чем влезает в префикс длины
+	ErrLengthTooLarge = errors.New("length too large")
+	// ErrOutOfRange - число не помещается в поле бинарного формата
+	ErrOutOfRange = errors.New("value out of range")
+	// ErrBadValue - байт bool не 0 и не 1 или varint длиннее 10 байт
+	ErrBadValue = errors.New("bad value")
+)
+
+// FieldError - ошибка упаковки или распаковки поля, Offset - начало поля в данных
+type FieldError struct {
+	Struct string
+	Field  string
+	Offset int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("binpack: %s.%s at offset %d: %v", e.Struct, e.Field, e.Offset, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// binpackChunk - сколько байт или элементов слайса выделять сразу при чтении из потока
+const binpackChunk = 4096
+
+// binpackReader - источник данных декодера, varint читается по байту
+type binpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// binpackDecoder читает значения по порядку; первая ошибка запоминается, после неё читаются нули.
+// Unpack читает прямо из слайса data, без binary.Read и рефлексии, DecodeFrom - из потока stream
+type binpackDecoder struct {
+	data   []byte
+	stream *binpackStream
+	// end - где кончаются данные или тело версионной структуры, -1 - поток без предела
+	end int
+	// offset - сколько байт data уже прочитано
+	offset int
+	order  binary.ByteOrder
+	// field - начало текущего поля, для FieldError
+	field int
+	err   error
+}
+
+func newBinpackDecoder(data []byte) *binpackDecoder {
+	return &binpackDecoder{data: data, end: len(data), order: binary.LittleEndian}
+}
+
+// newBinpackStreamDecoder читает из потока ровно столько байт, сколько занимает структура,
+// поэтому структуры можно читать из одного потока подряд
+func newBinpackStreamDecoder(r io.Reader) *binpackDecoder {
+	br, ok := r.(binpackReader)
+	if !ok {
+		br = &binpackByteReader{Reader: r}
+	}
+	return &binpackDecoder{stream: &binpackStream{r: br, end: -1}, end: -1, order: binary.LittleEndian}
+}
+
+// binpackStream считает прочитанные из потока байты для смещений в FieldError;
+// он отдельно от декодера, чтобы декодер Unpack не уходил в кучу через интерфейсы io
+type binpackStream struct {
+	r binpackReader
+	n int
+	// end - конец тела версионной структуры, дальше поток читается только через leave
+	end int
+}
+
+func (s *binpackStream) Read(p []byte) (int, error) {
+	if s.end >= 0 {
+		if s.n >= s.end {
+			return 0, io.EOF
+		}
+		if len(p) > s.end-s.n {
+			p = p[:s.end-s.n]
+		}
+	}
+	n, err := s.r.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *binpackStream) ReadByte() (byte, error) {
+	if s.end >= 0 && s.n >= s.end {
+		return 0, io.EOF
+	}
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.n++
+	}
+	return b, err
+}
+
+// binpackByteReader читает по одному байту без буфера, чтобы не забрать из потока лишнего;
+// для скорости в DecodeFrom лучше передать *bufio.Reader
+type binpackByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *binpackByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.Reader, r.b[:])
+	return r.b[0], err
+}
+
+// pos - сколько байт уже прочитано
+func (d *binpackDecoder) pos() int {
+	if d.stream != nil {
+		return d.stream.n
+	}
+	return d.offset
+}
+
+// begin отмечает начало поля; порядок байт ставится заново, потому что вложенная структура могла его поменять
+func (d *binpackDecoder) begin(order binary.ByteOrder) {
+	d.field = d.pos()
+	d.order = order
+}
+
+// streamErr - результат DecodeFrom: если поток кончился до первого байта структуры, это io.EOF, как у binary.Read
+func (d *binpackDecoder) streamErr() error {
+	if d.pos() == 0 && errors.Is(d.err, ErrShortBuffer) {
+		return io.EOF
+	}
+	return d.err
+}
+
+// enter читает заголовок версионной структуры - версию и длину тела - и ограничивает чтение телом;
+// outer - прежний предел, его возвращает leave
+func (d *binpackDecoder) enter() (version uint64, outer int) {
+	version = d.varint()
+	size := d.length(uint64(d.uint32()), 0)
+	outer = d.end
+	if d.err == nil {
+		d.setEnd(d.pos() + size)
+	}
+	return version, outer
+}
+
+// leave пропускает непрочитанный конец тела - поля из более новой версии - и возвращает внешний предел
+func (d *binpackDecoder) leave(outer int) {
+	if d.err == nil && d.pos() < d.end {
+		if d.stream == nil {
+			d.offset = d.end
+		} else {
+			_, d.err = io.CopyN(io.Discard, d.stream, int64(d.end-d.pos()))
+		}
+	}
+	d.setEnd(outer)
+}
+
+func (d *binpackDecoder) setEnd(end int) {
+	d.end = end
+	if d.stream != nil {
+		d.stream.end = end
+	}
+}
+
+// failed заворачивает ошибку в FieldError, ошибки вложенных структур уже завёрнуты
+func (d *binpackDecoder) failed(structName, field string) bool {
+	if d.err == nil {
+		return false
+	}
+	var fieldErr *FieldError
+	if !errors.As(d.err, &fieldErr) {
+		if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+			d.err = ErrShortBuffer
+		}
+		d.err = &FieldError{Struct: structName, Field: field, Offset: d.field, Err: d.err}
+	}
+	return true
+}
+
+func (d *binpackDecoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.stream, d.order, v)
+	}
+}
+
+// take отдаёт следующие n байт из data без копирования, nil - данные кончились или уже была ошибка
+func (d *binpackDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > d.end-d.offset {
+		d.err = ErrShortBuffer
+		return nil
+	}
+	v := d.data[d.offset : d.offset+n : d.offset+n]
+	d.offset += n
+	return v
+}
+
+func (d *binpackDecoder) uint8() uint8 {
+	if d.stream == nil {
+		if b := d.take(1); b != nil {
+			return b[0]
+		}
+		return 0
+	}
+	var v uint8
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint16() uint16 {
+	if d.stream == nil {
+		if b := d.take(2); b != nil {
+			return d.order.Uint16(b)
+		}
+		return 0
+	}
+	var v uint16
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint32() uint32 {
+	if d.stream == nil {
+		if b := d.take(4); b != nil {
+			return d.order.Uint32(b)
+		}
+		return 0
+	}
+	var v uint32
+	d.read(&v)
+	return v
+}
+
+func (d *binpackDecoder) uint64() uint64 {
+	if d.stream == nil {
+		if b := d.take(8); b != nil {
+			return d.order.Uint64(b)
+		}
+		return 0
+	}
+	var v uint64
+	d.read(&v)
+	return v
+}
+
+// varint читает LEB128, как в protobuf
+func (d *binpackDecoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if d.stream == nil {
+		v, n := binary.Uvarint(d.data[d.offset:d.end])
+		switch {
+		case n == 0:
+			d.err = ErrShortBuffer
+		case n < 0:
+			d.err = ErrBadValue
+		default:
+			d.offset += n
+		}
+		return v
+	}
+	v, err := binary.ReadUvarint(d.stream)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		d.err = err
+	case err != nil:
+		d.err = ErrBadValue
+	}
+	return v
+}
+
+// zigzag читает знаковый varint, как sint64 в protobuf, и возвращает его биты
+func (d *binpackDecoder) zigzag() uint64 {
+	v := d.varint()
+	return uint64(int64(v>>1) ^ -int64(v&1))
+}
+
+func (d *binpackDecoder) bool() bool {
+	v := d.uint8()
+	if v > 1 && d.err == nil {
+		d.err = ErrBadValue
+	}
+	return v == 1
+}
+
+func (d *binpackDecoder) float32() float32 {
+	return math.Float32frombits(d.uint32())
+}
+
+func (d *binpackDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// checkUint и checkInt - значение из данных не помещается в тип поля
+func (d *binpackDecoder) checkUint(v, max uint64) uint64 {
+	if v > max && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+func (d *binpackDecoder) checkInt(v, min, max int64) int64 {
+	if (v < min || v > max) && d.err == nil {
+		d.err = ErrOutOfRange
+	}
+	return v
+}
+
+// length проверяет прочитанный префикс длины до всякого make,
+// чтобы испорченный префикс не просил гигабайты
+func (d *binpackDecoder) length(n uint64, maxLen int) int {
+	switch {
+	case d.err != nil:
+		return 0
+	case maxLen > 0 && n > uint64(maxLen):
+		d.err = ErrLengthTooLarge
+		return 0
+	case d.end >= 0 && n > uint64(d.end-d.pos()):
+		d.err = ErrShortBuffer
+		return 0
+	case n > math.MaxInt32:
+		// столько в память всё равно не поместить
+		d.err = ErrLengthTooLarge
+		return 0
+	}
+	return int(n)
+}
+
+// capacity - сколько элементов слайса выделить сразу; в потоке длину нечем проверить
+// (длина тела версионной структуры тоже только заявлена), поэтому слайс растёт по мере чтения
+func (d *binpackDecoder) capacity(n int) int {
+	if d.stream != nil && n > binpackChunk {
+		return binpackChunk
+	}
+	return n
+}
+
+func (d *binpackDecoder) bytes(n int) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if d.stream == nil {
+		return append([]byte(nil), d.take(n)...)
+	}
+	if d.stream != nil && n > binpackChunk {
+		buf := bytes.Buffer{}
+		buf.Grow(binpackChunk)
+		_, d.err = io.CopyN(&buf, d.stream, int64(n))
+		return buf.Bytes()
+	}
+	v := make([]byte, n)
+	_, d.err = io.ReadFull(d.stream, v)
+	return v
+}
+
+// string копирует байты строки один раз, без промежуточного []byte
+func (d *binpackDecoder) string(n int) string {
+	if d.stream == nil {
+		return string(d.take(n))
+	}
+	return string(d.bytes(n))
+}
+
+// alias и aliasString для cgen:"noalloc" ссылаются на данные Unpack без копирования,
+// такие поля живут, пока данные не меняют; из потока ссылаться не на что, там это обычное чтение
+func (d *binpackDecoder) alias(n int) []byte {
+	if d.stream == nil {
+		if n == 0 {
+			return nil
+		}
+		return d.take(n)
+	}
+	return d.bytes(n)
+}
+
+func (d *binpackDecoder) aliasString(n int) string {
+	if d.stream == nil {
+		if b := d.take(n); len(b) > 0 {
+			return unsafe.String(&b[0], len(b))
+		}
+		return ""
+	}
+	return string(d.bytes(n))
+}
+
+func (d *binpackDecoder) fill(v []byte) {
+	switch {
+	case d.stream == nil:
+		copy(v, d.take(len(v)))
+	case d.err == nil:
+		_, d.err = io.ReadFull(d.stream, v)
+	}
+}
+
+func binpackBool(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Message - структура с // cgen: binpack
+type Message interface {
+	Unpack(data []byte) error
+	AppendPack(dst []byte) ([]byte, error)
+}
+
+// DefaultMaxFrameSize - предел длины записи у FrameReader по умолчанию
+const DefaultMaxFrameSize = 16 << 20
+
+// FrameReader читает поток записей с префиксом длины varint, как writeDelimitedTo в protobuf;
+// в памяти держится только текущая запись, поэтому поля cgen:"noalloc" живут до следующего Next
+type FrameReader struct {
+	r *bufio.Reader
+	// MaxSize - предел длины одной записи, чтобы испорченный префикс не просил гигабайты
+	MaxSize int
+	buf     []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), MaxSize: DefaultMaxFrameSize}
+}
+
+// Next читает следующую запись в m, когда записи кончились - возвращает io.EOF
+func (fr *FrameReader) Next(m Message) error {
+	size, err := binary.ReadUvarint(fr.r)
+	switch {
+	case err == io.EOF:
+		return io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("binpack: frame length: %w", ErrShortBuffer)
+	case err != nil:
+		return fmt.Errorf("binpack: frame length: %w", ErrBadValue)
+	case size > uint64(fr.MaxSize):
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrLengthTooLarge)
+	}
+
+	if uint64(cap(fr.buf)) < size {
+		fr.buf = make([]byte, size)
+	}
+	fr.buf = fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, fr.buf); err != nil {
+		return fmt.Errorf("binpack: frame of %d bytes: %w", size, ErrShortBuffer)
+	}
+	return m.Unpack(fr.buf)
+}
+
+// FrameWriter пишет записи для FrameReader
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write пакует m и пишет её одной записью
+func (fw *FrameWriter) Write(m Message) error {
+	var err error
+	// длина известна только после упаковки, поэтому префикс пишется отдельно
+	if fw.buf, err = m.AppendPack(fw.buf[:0]); err != nil {
+		return err
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(fw.buf)))
+	if _, err = fw.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = fw.w.Write(fw.buf)
+	return err
+}
+
+// UserPackTemplate - тот же формат для pack и unpack в perl
+const UserPackTemplate = "V V/a* V"
 
 func (in *User) Unpack(data []byte) error {
-	r := bytes.NewReader(data)
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *User) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
 
+func (in *User) decodeBinpack(d *binpackDecoder) {
 	// ID
-	var IDRaw uint32
-	binary.Read(r, binary.LittleEndian, &IDRaw)
-	in.ID = int(IDRaw)
+	d.begin(binary.LittleEndian)
+	in.ID = int(d.uint32())
+	if d.failed("User", "ID") {
+		return
+	}
+	// Login
+	d.begin(binary.LittleEndian)
+	in.Login = d.aliasString(d.length(uint64(d.uint32()), 256))
+	if d.failed("User", "Login") {
+		return
+	}
+	// Flags
+	d.begin(binary.LittleEndian)
+	in.Flags = int(d.uint32())
+	if d.failed("User", "Flags") {
+		return
+	}
+}
 
+func (in *User) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *User) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *User) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *User) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// ID
+	if int64(in.ID) < 0 || uint64(in.ID) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "User", Field: "ID", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(in.ID))
 	// Login
-	var LoginLenRaw uint32
-	binary.Read(r, binary.LittleEndian, &LoginLenRaw)
-	LoginRaw := make([]byte, LoginLenRaw)
-	binary.Read(r, binary.LittleEndian, &LoginRaw)
-	in.Login = string(LoginRaw)
+	if len(in.Login) > 256 {
+		return dst[:start], &FieldError{Struct: "User", Field: "Login", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Login)))
+	dst = append(dst, in.Login...)
+	// Flags
+	if int64(in.Flags) < 0 || uint64(in.Flags) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "User", Field: "Flags", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(in.Flags))
+	return dst, nil
+}
+
+func (in *Session) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *Session) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *Session) decodeBinpack(d *binpackDecoder) {
+	// Token
+	d.begin(binary.LittleEndian)
+	d.fill(in.Token[:])
+	if d.failed("Session", "Token") {
+		return
+	}
+	// Owner
+	d.begin(binary.LittleEndian)
+	in.Owner.decodeBinpack(d)
+	if d.failed("Session", "Owner") {
+		return
+	}
+	// Status
+	d.begin(binary.LittleEndian)
+	in.Status = Status(d.uint8())
+	if d.failed("Session", "Status") {
+		return
+	}
+	// Online
+	d.begin(binary.LittleEndian)
+	in.Online = d.bool()
+	if d.failed("Session", "Online") {
+		return
+	}
+	// Rating
+	d.begin(binary.LittleEndian)
+	in.Rating = d.float32()
+	if d.failed("Session", "Rating") {
+		return
+	}
+	// Balance
+	d.begin(binary.LittleEndian)
+	in.Balance = d.float64()
+	if d.failed("Session", "Balance") {
+		return
+	}
+	// Delta
+	d.begin(binary.LittleEndian)
+	in.Delta = int16(d.uint16())
+	if d.failed("Session", "Delta") {
+		return
+	}
+	// Small
+	d.begin(binary.LittleEndian)
+	in.Small = int8(d.uint8())
+	if d.failed("Session", "Small") {
+		return
+	}
+	// Seq
+	d.begin(binary.LittleEndian)
+	in.Seq = d.uint64()
+	if d.failed("Session", "Seq") {
+		return
+	}
+	// Stamp
+	d.begin(binary.LittleEndian)
+	in.Stamp = int64(d.uint64())
+	if d.failed("Session", "Stamp") {
+		return
+	}
+	// Counter
+	d.begin(binary.LittleEndian)
+	in.Counter = uint(d.uint32())
+	if d.failed("Session", "Counter") {
+		return
+	}
+	// Tags
+	d.begin(binary.LittleEndian)
+	in.Tags = nil
+	if n0 := d.length(uint64(d.uint32()), 32); n0 > 0 {
+		in.Tags = make([]string, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 string
+			v0 = d.string(d.length(uint64(d.uint32()), 0))
+			in.Tags = append(in.Tags, v0)
+		}
+	}
+	if d.failed("Session", "Tags") {
+		return
+	}
+	// Scores
+	d.begin(binary.LittleEndian)
+	in.Scores = nil
+	if n0 := d.length(uint64(d.uint32()), 0); n0 > 0 {
+		in.Scores = make([]int32, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 int32
+			v0 = int32(d.uint32())
+			in.Scores = append(in.Scores, v0)
+		}
+	}
+	if d.failed("Session", "Scores") {
+		return
+	}
+	// Picture
+	d.begin(binary.LittleEndian)
+	in.Picture = d.alias(d.length(uint64(d.uint32()), 65536))
+	if d.failed("Session", "Picture") {
+		return
+	}
+	// Window
+	d.begin(binary.LittleEndian)
+	for i0 := range in.Window {
+		in.Window[i0] = d.uint16()
+	}
+	if d.failed("Session", "Window") {
+		return
+	}
+	// Guests
+	d.begin(binary.LittleEndian)
+	in.Guests = nil
+	if n0 := d.length(uint64(d.uint32()), 0); n0 > 0 {
+		in.Guests = make([]User, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 User
+			v0.decodeBinpack(d)
+			in.Guests = append(in.Guests, v0)
+		}
+	}
+	if d.failed("Session", "Guests") {
+		return
+	}
+	// Statuses
+	d.begin(binary.LittleEndian)
+	for i0 := range in.Statuses {
+		in.Statuses[i0] = Status(d.uint8())
+	}
+	if d.failed("Session", "Statuses") {
+		return
+	}
+}
+
+func (in *Session) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *Session) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *Session) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *Session) appendBinpack(dst []byte, start int) ([]byte, error) {
+	var err error
+	// Token
+	dst = append(dst, in.Token[:]...)
+	// Owner
+	if dst, err = in.Owner.appendBinpack(dst, start); err != nil {
+		return dst, err
+	}
+	// Status
+	dst = append(dst, byte(in.Status))
+	// Online
+	dst = append(dst, binpackBool(bool(in.Online)))
+	// Rating
+	dst = binary.LittleEndian.AppendUint32(dst, math.Float32bits(float32(in.Rating)))
+	// Balance
+	dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(float64(in.Balance)))
+	// Delta
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(in.Delta))
+	// Small
+	dst = append(dst, byte(in.Small))
+	// Seq
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(in.Seq))
+	// Stamp
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(in.Stamp))
+	// Counter
+	if uint64(in.Counter) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Session", Field: "Counter", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(in.Counter))
+	// Tags
+	if len(in.Tags) > 32 {
+		return dst[:start], &FieldError{Struct: "Session", Field: "Tags", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Tags)))
+	for i0 := range in.Tags {
+		if uint64(len(in.Tags[i0])) > math.MaxUint32 {
+			return dst[:start], &FieldError{Struct: "Session", Field: "Tags", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+		}
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Tags[i0])))
+		dst = append(dst, in.Tags[i0]...)
+	}
+	// Scores
+	if uint64(len(in.Scores)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Session", Field: "Scores", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Scores)))
+	for i0 := range in.Scores {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(in.Scores[i0]))
+	}
+	// Picture
+	if len(in.Picture) > 65536 {
+		return dst[:start], &FieldError{Struct: "Session", Field: "Picture", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Picture)))
+	dst = append(dst, in.Picture...)
+	// Window
+	for i0 := range in.Window {
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(in.Window[i0]))
+	}
+	// Guests
+	if uint64(len(in.Guests)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Session", Field: "Guests", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Guests)))
+	for i0 := range in.Guests {
+		if dst, err = in.Guests[i0].appendBinpack(dst, start); err != nil {
+			return dst, err
+		}
+	}
+	// Statuses
+	for i0 := range in.Statuses {
+		dst = append(dst, byte(in.Statuses[i0]))
+	}
+	return dst, nil
+}
+
+func (in *Packet) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *Packet) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *Packet) decodeBinpack(d *binpackDecoder) {
+	// Version
+	d.begin(binary.BigEndian)
+	in.Version = int(d.uint8())
+	if d.failed("Packet", "Version") {
+		return
+	}
+	// Kind
+	d.begin(binary.BigEndian)
+	in.Kind = Status(d.uint8())
+	if d.failed("Packet", "Kind") {
+		return
+	}
+	// Length
+	d.begin(binary.BigEndian)
+	in.Length = int(d.uint16())
+	if d.failed("Packet", "Length") {
+		return
+	}
+	// Host
+	d.begin(binary.BigEndian)
+	in.Host = d.aliasString(d.length(uint64(d.uint8()), 255))
+	if d.failed("Packet", "Host") {
+		return
+	}
+	// Path
+	d.begin(binary.BigEndian)
+	in.Path = d.aliasString(d.length(uint64(d.uint16()), 0))
+	if d.failed("Packet", "Path") {
+		return
+	}
+	// Ports
+	d.begin(binary.BigEndian)
+	in.Ports = nil
+	if n0 := d.length(uint64(d.uint16()), 0); n0 > 0 {
+		in.Ports = make([]int, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 int
+			v0 = int(d.uint16())
+			in.Ports = append(in.Ports, v0)
+		}
+	}
+	if d.failed("Packet", "Ports") {
+		return
+	}
+	// Shift
+	d.begin(binary.BigEndian)
+	in.Shift = int16(d.checkInt(int64(int32(d.uint32())), math.MinInt16, math.MaxInt16))
+	if d.failed("Packet", "Shift") {
+		return
+	}
+	// Hops
+	d.begin(binary.BigEndian)
+	in.Hops = uint8(d.checkUint(uint64(d.uint16()), math.MaxUint8))
+	if d.failed("Packet", "Hops") {
+		return
+	}
+	// Session
+	d.begin(binary.BigEndian)
+	in.Session.decodeBinpack(d)
+	if d.failed("Packet", "Session") {
+		return
+	}
+}
+
+func (in *Packet) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *Packet) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *Packet) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
 
+func (in *Packet) appendBinpack(dst []byte, start int) ([]byte, error) {
+	var err error
+	// Version
+	if int64(in.Version) < 0 || uint64(in.Version) > math.MaxUint8 {
+		return dst[:start], &FieldError{Struct: "Packet", Field: "Version", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = append(dst, byte(in.Version))
+	// Kind
+	dst = append(dst, byte(in.Kind))
+	// Length
+	if int64(in.Length) < 0 || uint64(in.Length) > math.MaxUint16 {
+		return dst[:start], &FieldError{Struct: "Packet", Field: "Length", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(in.Length))
+	// Host
+	if len(in.Host) > 255 {
+		return dst[:start], &FieldError{Struct: "Packet", Field: "Host", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = append(dst, byte(len(in.Host)))
+	dst = append(dst, in.Host...)
+	// Path
+	if uint64(len(in.Path)) > math.MaxUint16 {
+		return dst[:start], &FieldError{Struct: "Packet", Field: "Path", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(in.Path)))
+	dst = append(dst, in.Path...)
+	// Ports
+	if uint64(len(in.Ports)) > math.MaxUint16 {
+		return dst[:start], &FieldError{Struct: "Packet", Field: "Ports", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(in.Ports)))
+	for i0 := range in.Ports {
+		if int64(in.Ports[i0]) < 0 || uint64(in.Ports[i0]) > math.MaxUint16 {
+			return dst[:start], &FieldError{Struct: "Packet", Field: "Ports", Offset: len(dst) - start, Err: ErrOutOfRange}
+		}
+		dst = binary.BigEndian.AppendUint16(dst, uint16(in.Ports[i0]))
+	}
+	// Shift
+	dst = binary.BigEndian.AppendUint32(dst, uint32(in.Shift))
+	// Hops
+	dst = binary.BigEndian.AppendUint16(dst, uint16(in.Hops))
+	// Session
+	if dst, err = in.Session.appendBinpack(dst, start); err != nil {
+		return dst, err
+	}
+	return dst, nil
+}
+
+func (in *Counters) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *Counters) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *Counters) decodeBinpack(d *binpackDecoder) {
+	// Hits
+	d.begin(binary.LittleEndian)
+	in.Hits = d.varint()
+	if d.failed("Counters", "Hits") {
+		return
+	}
+	// Level
+	d.begin(binary.LittleEndian)
+	in.Level = int32(d.checkInt(int64(d.varint()), math.MinInt32, math.MaxInt32))
+	if d.failed("Counters", "Level") {
+		return
+	}
+	// Delta
+	d.begin(binary.LittleEndian)
+	in.Delta = int64(d.zigzag())
+	if d.failed("Counters", "Delta") {
+		return
+	}
+	// Errors
+	d.begin(binary.LittleEndian)
+	in.Errors = int(d.checkUint(d.varint(), math.MaxInt64))
+	if d.failed("Counters", "Errors") {
+		return
+	}
+	// Offsets
+	d.begin(binary.LittleEndian)
+	in.Offsets = nil
+	if n0 := d.length(d.varint(), 0); n0 > 0 {
+		in.Offsets = make([]int32, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 int32
+			v0 = int32(d.checkInt(int64(d.zigzag()), math.MinInt32, math.MaxInt32))
+			in.Offsets = append(in.Offsets, v0)
+		}
+	}
+	if d.failed("Counters", "Offsets") {
+		return
+	}
+	// Owner
+	d.begin(binary.LittleEndian)
+	in.Owner.decodeBinpack(d)
+	if d.failed("Counters", "Owner") {
+		return
+	}
+	// Name
+	d.begin(binary.LittleEndian)
+	in.Name = d.string(d.length(d.varint(), 200))
+	if d.failed("Counters", "Name") {
+		return
+	}
+	// Labels
+	d.begin(binary.LittleEndian)
+	in.Labels = nil
+	if n0 := d.length(d.varint(), 0); n0 > 0 {
+		in.Labels = make([]string, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 string
+			v0 = d.string(d.length(d.varint(), 0))
+			in.Labels = append(in.Labels, v0)
+		}
+	}
+	if d.failed("Counters", "Labels") {
+		return
+	}
+}
+
+func (in *Counters) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *Counters) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *Counters) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *Counters) appendBinpack(dst []byte, start int) ([]byte, error) {
+	var err error
+	// Hits
+	dst = binary.AppendUvarint(dst, uint64(in.Hits))
+	// Level
+	dst = binary.AppendUvarint(dst, uint64(in.Level))
+	// Delta
+	dst = binary.AppendVarint(dst, int64(in.Delta))
+	// Errors
+	if int64(in.Errors) < 0 {
+		return dst[:start], &FieldError{Struct: "Counters", Field: "Errors", Offset: len(dst) - start, Err: ErrOutOfRange}
+	}
+	dst = binary.AppendUvarint(dst, uint64(in.Errors))
+	// Offsets
+	dst = binary.AppendUvarint(dst, uint64(len(in.Offsets)))
+	for i0 := range in.Offsets {
+		dst = binary.AppendVarint(dst, int64(in.Offsets[i0]))
+	}
+	// Owner
+	if dst, err = in.Owner.appendBinpack(dst, start); err != nil {
+		return dst, err
+	}
+	// Name
+	if len(in.Name) > 200 {
+		return dst[:start], &FieldError{Struct: "Counters", Field: "Name", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(in.Name)))
+	dst = append(dst, in.Name...)
+	// Labels
+	dst = binary.AppendUvarint(dst, uint64(len(in.Labels)))
+	for i0 := range in.Labels {
+		dst = binary.AppendUvarint(dst, uint64(len(in.Labels[i0])))
+		dst = append(dst, in.Labels[i0]...)
+	}
+	return dst, nil
+}
+
+func (in *Profile) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *Profile) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *Profile) decodeBinpack(d *binpackDecoder) {
+	// заголовок версии
+	d.begin(binary.LittleEndian)
+	version, outer := d.enter()
+	if d.failed("Profile", "version") {
+		return
+	}
+	// ID
+	d.begin(binary.LittleEndian)
+	in.ID = d.varint()
+	if d.failed("Profile", "ID") {
+		return
+	}
+	// Name
+	d.begin(binary.LittleEndian)
+	in.Name = d.string(d.length(uint64(d.uint32()), 0))
+	if d.failed("Profile", "Name") {
+		return
+	}
+	if version < 2 {
+		var zero Profile
+		in.Email = zero.Email
+		in.Friends = zero.Friends
+		d.leave(outer)
+		return
+	}
+	// Email
+	d.begin(binary.LittleEndian)
+	in.Email = d.string(d.length(uint64(d.uint32()), 0))
+	if d.failed("Profile", "Email") {
+		return
+	}
+	// Friends
+	d.begin(binary.LittleEndian)
+	in.Friends = nil
+	if n0 := d.length(uint64(d.uint32()), 0); n0 > 0 {
+		in.Friends = make([]uint64, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 uint64
+			v0 = d.varint()
+			in.Friends = append(in.Friends, v0)
+		}
+	}
+	if d.failed("Profile", "Friends") {
+		return
+	}
+	d.leave(outer)
+}
+
+func (in *Profile) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
+}
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *Profile) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *Profile) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *Profile) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// заголовок версии
+	dst = binary.AppendUvarint(dst, 2)
+	body := len(dst) + 4
+	dst = append(dst, 0, 0, 0, 0)
+	// ID
+	dst = binary.AppendUvarint(dst, uint64(in.ID))
+	// Name
+	if uint64(len(in.Name)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Profile", Field: "Name", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Name)))
+	dst = append(dst, in.Name...)
+	// Email
+	if uint64(len(in.Email)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Profile", Field: "Email", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Email)))
+	dst = append(dst, in.Email...)
+	// Friends
+	if uint64(len(in.Friends)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Profile", Field: "Friends", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(in.Friends)))
+	for i0 := range in.Friends {
+		dst = binary.AppendUvarint(dst, uint64(in.Friends[i0]))
+	}
+	if uint64(len(dst)-body) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "Profile", Field: "version", Offset: body - 4 - start, Err: ErrLengthTooLarge}
+	}
+	binary.LittleEndian.PutUint32(dst[body-4:], uint32(len(dst)-body))
+	return dst, nil
+}
+
+// LegacyEventPackTemplate - тот же формат для pack и unpack в perl
+const LegacyEventPackTemplate = "n N/a* C v3 d> l> C N/n*"
+
+func (in *LegacyEvent) Unpack(data []byte) error {
+	d := newBinpackDecoder(data)
+	in.decodeBinpack(d)
+	return d.err
+}
+
+// DecodeFrom читает структуру из потока; если поток кончился до её начала, возвращает io.EOF
+func (in *LegacyEvent) DecodeFrom(r io.Reader) error {
+	d := newBinpackStreamDecoder(r)
+	in.decodeBinpack(d)
+	return d.streamErr()
+}
+
+func (in *LegacyEvent) decodeBinpack(d *binpackDecoder) {
+	// Kind
+	d.begin(binary.BigEndian)
+	in.Kind = d.uint16()
+	if d.failed("LegacyEvent", "Kind") {
+		return
+	}
+	// Payload
+	d.begin(binary.BigEndian)
+	in.Payload = d.bytes(d.length(uint64(d.uint32()), 0))
+	if d.failed("LegacyEvent", "Payload") {
+		return
+	}
 	// Flags
-	var FlagsRaw uint32
-	binary.Read(r, binary.LittleEndian, &FlagsRaw)
-	in.Flags = int(FlagsRaw)
-	return nil
+	d.begin(binary.LittleEndian)
+	in.Flags = d.uint8()
+	if d.failed("LegacyEvent", "Flags") {
+		return
+	}
+	// Ports
+	d.begin(binary.LittleEndian)
+	for i0 := range in.Ports {
+		in.Ports[i0] = d.uint16()
+	}
+	if d.failed("LegacyEvent", "Ports") {
+		return
+	}
+	// Score
+	d.begin(binary.BigEndian)
+	in.Score = d.float64()
+	if d.failed("LegacyEvent", "Score") {
+		return
+	}
+	// Delta
+	d.begin(binary.BigEndian)
+	in.Delta = int32(d.uint32())
+	if d.failed("LegacyEvent", "Delta") {
+		return
+	}
+	// Active
+	d.begin(binary.LittleEndian)
+	in.Active = d.bool()
+	if d.failed("LegacyEvent", "Active") {
+		return
+	}
+	// Hosts
+	d.begin(binary.BigEndian)
+	in.Hosts = nil
+	if n0 := d.length(uint64(d.uint32()), 0); n0 > 0 {
+		in.Hosts = make([]uint16, 0, d.capacity(n0))
+		for i0 := 0; i0 < n0 && d.err == nil; i0++ {
+			var v0 uint16
+			v0 = d.uint16()
+			in.Hosts = append(in.Hosts, v0)
+		}
+	}
+	if d.failed("LegacyEvent", "Hosts") {
+		return
+	}
+}
+
+func (in *LegacyEvent) Pack() ([]byte, error) {
+	return in.AppendPack(nil)
 }
+
+// AppendPack дописывает запакованную структуру в dst, как append
+func (in *LegacyEvent) AppendPack(dst []byte) ([]byte, error) {
+	return in.appendBinpack(dst, len(dst))
+}
+
+func (in *LegacyEvent) EncodeTo(w io.Writer) error {
+	data, err := in.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (in *LegacyEvent) appendBinpack(dst []byte, start int) ([]byte, error) {
+	// Kind
+	dst = binary.BigEndian.AppendUint16(dst, uint16(in.Kind))
+	// Payload
+	if uint64(len(in.Payload)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "LegacyEvent", Field: "Payload", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(in.Payload)))
+	dst = append(dst, in.Payload...)
+	// Flags
+	dst = append(dst, byte(in.Flags))
+	// Ports
+	for i0 := range in.Ports {
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(in.Ports[i0]))
+	}
+	// Score
+	dst = binary.BigEndian.AppendUint64(dst, math.Float64bits(float64(in.Score)))
+	// Delta
+	dst = binary.BigEndian.AppendUint32(dst, uint32(in.Delta))
+	// Active
+	dst = append(dst, binpackBool(bool(in.Active)))
+	// Hosts
+	if uint64(len(in.Hosts)) > math.MaxUint32 {
+		return dst[:start], &FieldError{Struct: "LegacyEvent", Field: "Hosts", Offset: len(dst) - start, Err: ErrLengthTooLarge}
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(in.Hosts)))
+	for i0 := range in.Hosts {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(in.Hosts[i0]))
+	}
+	return dst, nil
+}
+
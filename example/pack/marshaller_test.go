@@ -0,0 +1,1145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testUserValue() User {
+	return User{
+		ID: 1000003,
+		Login: "Login value",
+		Flags: 3000009,
+	}
+}
+
+func TestUserPackRoundTrip(t *testing.T) {
+	in := testUserValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := User{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestUserUnpackTruncated(t *testing.T) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := User{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestUserStream(t *testing.T) {
+	in := testUserValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := User{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&User{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&User{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestUserFrames(t *testing.T) {
+	in := testUserValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := User{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&User{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestUserUnpackNoAlloc(t *testing.T) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	out := User{}
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := out.Unpack(data); err != nil {
+			t.Fatalf("Unpack error: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Unpack must not allocate, got %v allocs", allocs)
+	}
+}
+
+func BenchmarkUserUnpack(b *testing.B) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := User{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkUserUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkUserUnpackReflect(b *testing.B) {
+	in := testUserValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := User{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkUserAppendPack(b *testing.B) {
+	in := testUserValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func TestUserLoginMaxLen(t *testing.T) {
+	in := testUserValue()
+	in.Login = strings.Repeat("x", 257)
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+
+	valid := testUserValue()
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	binary.LittleEndian.PutUint32(data[4:], 257)
+
+	out := User{}
+	err = out.Unpack(data)
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrLengthTooLarge) || !errors.As(err, &fieldErr) || fieldErr.Field != "Login" || fieldErr.Offset != 4 {
+		t.Errorf("Unpack: expected ErrLengthTooLarge for Login at offset 4, got %v", err)
+	}
+}
+
+func testSessionValue() Session {
+	return Session{
+		Token: [16]byte{102, 103, 104, 105, 106, 107, 108, 109, 110, 111, 112, 113, 114, 115, 116, 117},
+		Owner: User{ID: 3000009, Login: "Owner.Login value", Flags: 5000015},
+		Status: 103,
+		Online: false,
+		Rating: 5.5,
+		Balance: 6.5,
+		Delta: 30007,
+		Small: -108,
+		Seq: 1099511627785,
+		Stamp: -1099511627786,
+		Counter: 11000033,
+		Tags: []string{"Tags[0] value", "Tags[1] value"},
+		Scores: []int32{-1000000014, 1000000015},
+		Picture: []byte("Picture bytes"),
+		Window: [3]uint16{30016, 30017, 30018},
+		Guests: []User{User{ID: 18000054, Login: "Guests[0].Login value", Flags: 20000060}, User{ID: 19000057, Login: "Guests[1].Login value", Flags: 21000063}},
+		Statuses: [2]Status{118, 119},
+	}
+}
+
+func TestSessionPackRoundTrip(t *testing.T) {
+	in := testSessionValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := Session{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestSessionUnpackTruncated(t *testing.T) {
+	in := testSessionValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := Session{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestSessionStream(t *testing.T) {
+	in := testSessionValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := Session{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&Session{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&Session{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestSessionFrames(t *testing.T) {
+	in := testSessionValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := Session{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&Session{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkSessionUnpack(b *testing.B) {
+	in := testSessionValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Session{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkSessionUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkSessionUnpackReflect(b *testing.B) {
+	in := testSessionValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Session{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkSessionAppendPack(b *testing.B) {
+	in := testSessionValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func TestSessionTagsMaxLen(t *testing.T) {
+	in := testSessionValue()
+	in.Tags = make([]string, 33)
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+
+	valid := testSessionValue()
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	binary.LittleEndian.PutUint32(data[82:], 33)
+
+	out := Session{}
+	err = out.Unpack(data)
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrLengthTooLarge) || !errors.As(err, &fieldErr) || fieldErr.Field != "Tags" || fieldErr.Offset != 82 {
+		t.Errorf("Unpack: expected ErrLengthTooLarge for Tags at offset 82, got %v", err)
+	}
+}
+
+func TestSessionPictureMaxLen(t *testing.T) {
+	in := testSessionValue()
+	in.Picture = []byte(strings.Repeat("x", 65537))
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+
+	valid := testSessionValue()
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	binary.LittleEndian.PutUint32(data[132:], 65537)
+
+	out := Session{}
+	err = out.Unpack(data)
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrLengthTooLarge) || !errors.As(err, &fieldErr) || fieldErr.Field != "Picture" || fieldErr.Offset != 132 {
+		t.Errorf("Unpack: expected ErrLengthTooLarge for Picture at offset 132, got %v", err)
+	}
+}
+
+func testPacketValue() Packet {
+	return Packet{
+		Version: 101,
+		Kind: 102,
+		Length: 30003,
+		Host: "Host value",
+		Path: "Path value",
+		Ports: []int{30007, 30008},
+		Shift: 30007,
+		Hops: 108,
+		Session: Session{Token: [16]byte{111, 112, 113, 114, 115, 116, 117, 118, 119, 120, 121, 122, 123, 124, 125, 126}, Owner: User{ID: 12000036, Login: "Session.Owner.Login value", Flags: 14000042}, Status: 112, Online: true, Rating: 14.5, Balance: 15.5, Delta: -30016, Small: 117, Seq: 1099511627794, Stamp: 1099511627795, Counter: 20000060, Tags: []string{"Session.Tags[0] value", "Session.Tags[1] value"}, Scores: []int32{1000000023, -1000000024}, Picture: []byte("Session.Picture bytes"), Window: [3]uint16{30025, 30026, 30027}, Guests: []User{User{ID: 27000081, Login: "Session.Guests[0].Login value", Flags: 29000087}, User{ID: 28000084, Login: "Session.Guests[1].Login value", Flags: 30000090}}, Statuses: [2]Status{127, 128}},
+	}
+}
+
+func TestPacketPackRoundTrip(t *testing.T) {
+	in := testPacketValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := Packet{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestPacketUnpackTruncated(t *testing.T) {
+	in := testPacketValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := Packet{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestPacketStream(t *testing.T) {
+	in := testPacketValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := Packet{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&Packet{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&Packet{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestPacketFrames(t *testing.T) {
+	in := testPacketValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := Packet{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&Packet{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkPacketUnpack(b *testing.B) {
+	in := testPacketValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Packet{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkPacketUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkPacketUnpackReflect(b *testing.B) {
+	in := testPacketValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Packet{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkPacketAppendPack(b *testing.B) {
+	in := testPacketValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func TestPacketHostMaxLen(t *testing.T) {
+	in := testPacketValue()
+	in.Host = strings.Repeat("x", 256)
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+}
+
+func testCountersValue() Counters {
+	return Counters{
+		Hits: 1099511627777,
+		Level: -1000000002,
+		Delta: 1099511627779,
+		Errors: 1099511627780,
+		Offsets: []int32{-1000000006, 1000000007},
+		Owner: Profile{ID: 1099511627783, Name: "Owner.Name value", Email: "Owner.Email value", Friends: []uint64{1099511627787, 1099511627788}},
+		Name: "Name value",
+		Labels: []string{"Labels[0] value", "Labels[1] value"},
+	}
+}
+
+func TestCountersPackRoundTrip(t *testing.T) {
+	in := testCountersValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := Counters{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestCountersUnpackTruncated(t *testing.T) {
+	in := testCountersValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := Counters{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestCountersStream(t *testing.T) {
+	in := testCountersValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := Counters{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&Counters{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&Counters{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestCountersFrames(t *testing.T) {
+	in := testCountersValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := Counters{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&Counters{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkCountersUnpack(b *testing.B) {
+	in := testCountersValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Counters{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkCountersUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkCountersUnpackReflect(b *testing.B) {
+	in := testCountersValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Counters{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkCountersAppendPack(b *testing.B) {
+	in := testCountersValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func TestCountersNameMaxLen(t *testing.T) {
+	in := testCountersValue()
+	in.Name = strings.Repeat("x", 201)
+	if _, err := in.Pack(); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Pack: expected ErrLengthTooLarge, got %v", err)
+	}
+
+	valid := testCountersValue()
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	binary.PutUvarint(data[107:], 201)
+
+	out := Counters{}
+	err = out.Unpack(data)
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrLengthTooLarge) || !errors.As(err, &fieldErr) || fieldErr.Field != "Name" || fieldErr.Offset != 107 {
+		t.Errorf("Unpack: expected ErrLengthTooLarge for Name at offset 107, got %v", err)
+	}
+}
+
+func testProfileValue() Profile {
+	return Profile{
+		ID: 1099511627777,
+		Name: "Name value",
+		Email: "Email value",
+		Friends: []uint64{1099511627781, 1099511627782},
+	}
+}
+
+func TestProfilePackRoundTrip(t *testing.T) {
+	in := testProfileValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := Profile{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestProfileUnpackTruncated(t *testing.T) {
+	in := testProfileValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := Profile{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestProfileStream(t *testing.T) {
+	in := testProfileValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := Profile{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&Profile{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&Profile{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestProfileFrames(t *testing.T) {
+	in := testProfileValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := Profile{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&Profile{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+// старые данные: поля новых версий в них считаются неизвестным хвостом и обнуляются
+func TestProfileOlderVersion(t *testing.T) {
+	in := testProfileValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	data[0] = 1
+
+	want := in
+	zero := Profile{}
+	want.Email = zero.Email
+	want.Friends = zero.Friends
+
+	out := testProfileValue()
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(want, out) {
+		t.Errorf("version 1 mismatch:\nwant %#v\ngot  %#v", want, out)
+	}
+}
+
+// данные новой версии: неизвестные поля в конце тела пропускаются, в том числе в потоке
+func TestProfileNewerVersion(t *testing.T) {
+	in := testProfileValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	data[0] = 2 + 1
+	data = append(data, "new fields"...)
+	binary.LittleEndian.PutUint32(data[1:], binary.LittleEndian.Uint32(data[1:])+uint32(len("new fields")))
+
+	out := Profile{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unpack mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	r := struct{ io.Reader }{bytes.NewReader(append(data, data...))}
+	for i := 0; i < 2; i++ {
+		out := Profile{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+}
+
+func BenchmarkProfileUnpack(b *testing.B) {
+	in := testProfileValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Profile{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkProfileUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkProfileUnpackReflect(b *testing.B) {
+	in := testProfileValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := Profile{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkProfileAppendPack(b *testing.B) {
+	in := testProfileValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
+
+func testLegacyEventValue() LegacyEvent {
+	return LegacyEvent{
+		Kind: 30001,
+		Payload: []byte("Payload bytes"),
+		Flags: 103,
+		Ports: [3]uint16{30005, 30006, 30007},
+		Score: 5.5,
+		Delta: -1000000006,
+		Active: true,
+		Hosts: []uint16{30009, 30010},
+	}
+}
+
+func TestLegacyEventPackRoundTrip(t *testing.T) {
+	in := testLegacyEventValue()
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	out := LegacyEvent{}
+	if err := out.Unpack(data); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+
+	prefix := []byte("prefix")
+	appended, err := in.AppendPack(prefix)
+	if err != nil {
+		t.Fatalf("AppendPack error: %v", err)
+	}
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], data) {
+		t.Errorf("AppendPack must append Pack result to dst, got %v", appended)
+	}
+}
+
+func TestLegacyEventUnpackTruncated(t *testing.T) {
+	in := testLegacyEventValue()
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+
+	for size := 0; size < len(data); size++ {
+		out := LegacyEvent{}
+		err := out.Unpack(data[:size])
+		if !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("Unpack of %d bytes from %d: expected ErrShortBuffer, got %v", size, len(data), err)
+		}
+	}
+}
+
+func TestLegacyEventStream(t *testing.T) {
+	in := testLegacyEventValue()
+	stream := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		if err := in.EncodeTo(stream); err != nil {
+			t.Fatalf("EncodeTo error: %v", err)
+		}
+	}
+	whole := stream.Bytes()
+
+	// без io.ByteReader декодер читает по байту и не забирает чужие байты
+	r := struct{ io.Reader }{bytes.NewReader(whole)}
+	for i := 0; i < 2; i++ {
+		out := LegacyEvent{}
+		if err := out.DecodeFrom(r); err != nil {
+			t.Fatalf("DecodeFrom #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("DecodeFrom #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := (&LegacyEvent{}).DecodeFrom(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of stream, got %v", err)
+	}
+
+	if err := (&LegacyEvent{}).DecodeFrom(bytes.NewReader(whole[:len(whole)/2-1])); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("expected ErrShortBuffer for truncated stream, got %v", err)
+	}
+}
+
+func TestLegacyEventFrames(t *testing.T) {
+	in := testLegacyEventValue()
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for i := 0; i < 2; i++ {
+		if err := fw.Write(&in); err != nil {
+			t.Fatalf("FrameWriter error: %v", err)
+		}
+	}
+
+	fr := NewFrameReader(stream)
+	for i := 0; i < 2; i++ {
+		out := LegacyEvent{}
+		if err := fr.Next(&out); err != nil {
+			t.Fatalf("FrameReader #%d error: %v", i, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("frame #%d mismatch:\nwant %#v\ngot  %#v", i, in, out)
+		}
+	}
+	if err := fr.Next(&LegacyEvent{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func BenchmarkLegacyEventUnpack(b *testing.B) {
+	in := testLegacyEventValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := LegacyEvent{}
+		if err := out.Unpack(data); err != nil {
+			b.Fatalf("Unpack error: %v", err)
+		}
+	}
+}
+
+// BenchmarkLegacyEventUnpackReflect - тот же разбор через binary.Read, как у DecodeFrom, для сравнения
+func BenchmarkLegacyEventUnpackReflect(b *testing.B) {
+	in := testLegacyEventValue()
+	data, err := in.Pack()
+	if err != nil {
+		b.Fatalf("Pack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		out := LegacyEvent{}
+		d := newBinpackStreamDecoder(bytes.NewReader(data))
+		d.setEnd(len(data))
+		out.decodeBinpack(d)
+		if d.err != nil {
+			b.Fatalf("decode error: %v", d.err)
+		}
+	}
+}
+
+func BenchmarkLegacyEventAppendPack(b *testing.B) {
+	in := testLegacyEventValue()
+	buf, err := in.AppendPack(nil)
+	if err != nil {
+		b.Fatalf("AppendPack error: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if buf, err = in.AppendPack(buf[:0]); err != nil {
+			b.Fatalf("AppendPack error: %v", err)
+		}
+	}
+}
@@ -1,17 +1,96 @@
 // go build gen/* && ./codegen.exe pack/packer.go  pack/marshaller.go
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
 // lets generate code for this struct
-// cgen: binpack
+// формат тот же, что у perl в main
+// cgen: binpack template="L L/a* L"
 type User struct {
 	ID       int
 	RealName string `cgen:"-"`
-	Login    string
+	Login    string `cgen:"maxlen=256,noalloc"`
 	Flags    int
 }
 
+type Status uint8
+
+// сессия собрана из всех типов, которые понимает binpack
+// cgen: binpack
+type Session struct {
+	Token    [16]byte
+	Owner    User
+	Status   Status
+	Online   bool
+	Rating   float32
+	Balance  float64
+	Delta    int16
+	Small    int8
+	Seq      uint64
+	Stamp    int64
+	Counter  uint
+	Tags     []string `cgen:"maxlen=32"`
+	Scores   []int32
+	Picture  []byte `cgen:"maxlen=65536,noalloc"`
+	Window   [3]uint16
+	Guests   []User
+	Statuses [2]Status
+}
+
+// заголовок сетевого протокола: big endian и 16-битные длины,
+// вложенная Session остаётся little endian
+// cgen: binpack endian=big len=u16
+type Packet struct {
+	Version int `cgen:"u8"`
+	Kind    Status
+	Length  int    `cgen:"u16"`
+	Host    string `cgen:"maxlen=255,len=u8,noalloc"`
+	Path    string `cgen:"noalloc"`
+	Ports   []int  `cgen:"u16"`
+	Shift   int16  `cgen:"i32"`
+	Hops    uint8  `cgen:"u16"`
+	Session Session
+}
+
+// счётчики маленькие, поэтому varint, как в protobuf; длины тоже varint
+// cgen: binpack len=varint
+type Counters struct {
+	Hits    uint64  `cgen:"varint"`
+	Level   int32   `cgen:"varint"`
+	Delta   int64   `cgen:"zigzag"`
+	Errors  int     `cgen:"varint"`
+	Offsets []int32 `cgen:"zigzag"`
+	Owner   Profile
+	Name    string `cgen:"maxlen=200"`
+	Labels  []string
+}
+
+// профиль хранится долго, поэтому пишется с заголовком версии:
+// новые поля добавляются только в конец и с since
+// cgen: binpack version=2
+type Profile struct {
+	ID      uint64 `cgen:"varint"`
+	Name    string
+	Email   string   `cgen:"since=2"`
+	Friends []uint64 `cgen:"since=2,varint"`
+}
+
+// событие от старого perl-сервиса, формат взят прямо из его вызова pack
+// cgen: binpack template="n N/a* C v3 d> l> C N/n*"
+type LegacyEvent struct {
+	Kind    uint16
+	Payload []byte
+	Flags   uint8
+	Ports   [3]uint16
+	Score   float64
+	Delta   int32
+	Active  bool
+	Hosts   []uint16
+}
+
 type Avatar struct {
 	ID  int
 	Url string
@@ -35,5 +114,12 @@ func main() {
 
 	u := User{}
 	u.Unpack(data)
-	fmt.Printf("Unpacked user %#v", u)
+	fmt.Printf("Unpacked user %#v\n", u)
+
+	packed, err := u.Pack()
+	if err != nil {
+		fmt.Println("pack error:", err)
+		return
+	}
+	fmt.Printf("Packed back %v, same as perl: %v\n", packed, bytes.Equal(packed, data))
 }
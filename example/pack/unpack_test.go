@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// сгенерированные тесты гоняют Pack и Unpack друг через друга и не заметят ошибку, общую для обоих,
+// поэтому здесь байты расписаны руками
+
+func TestPacketBytes(t *testing.T) {
+	in := Packet{
+		Version: 2,
+		Kind:    3,
+		Length:  0x0102,
+		Host:    "ab",
+		Path:    "/x",
+		Ports:   []int{80, 443},
+		Shift:   -2,
+		Hops:    200,
+	}
+	want := []byte{
+		0x02,       // Version u8
+		0x03,       // Kind
+		0x01, 0x02, // Length u16 big endian
+		0x02, 'a', 'b', // Host, длина u8
+		0x00, 0x02, '/', 'x', // Path, длина u16 big endian
+		0x00, 0x02, 0x00, 0x50, 0x01, 0xbb, // Ports: количество u16, элементы u16
+		0xff, 0xff, 0xff, 0xfe, // Shift i32
+		0x00, 0xc8, // Hops u16
+	}
+	// нулевая Session: 16 байт Token, 12 байт User, дальше числа и пустые длины uint32
+	want = append(want, make([]byte, 89)...)
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("Pack bytes mismatch:\nwant % x\ngot  % x", want, data)
+	}
+
+	out := Packet{}
+	if err := out.Unpack(want); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unpack mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+}
+
+func TestPacketOutOfRange(t *testing.T) {
+	if _, err := (&Packet{Version: 256}).Pack(); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Pack of Version 256 into u8: want ErrOutOfRange, got %v", err)
+	}
+	if _, err := (&Packet{Shift: -1}).Pack(); err != nil {
+		t.Errorf("Pack of negative Shift into i32: %v", err)
+	}
+
+	valid, err := (&Packet{}).Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	cases := []struct {
+		Name   string
+		Offset int
+		Patch  []byte
+	}{
+		// Shift int16 лежит в i32, 65536 в него не помещается
+		{"Shift", 9, []byte{0x00, 0x01, 0x00, 0x00}},
+		// Hops uint8 лежит в u16
+		{"Hops", 13, []byte{0x01, 0x2c}},
+	}
+	for _, item := range cases {
+		data := append([]byte{}, valid...)
+		copy(data[item.Offset:], item.Patch)
+		out := Packet{}
+		if err := out.Unpack(data); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%s: want ErrOutOfRange, got %v", item.Name, err)
+		}
+	}
+}
+
+// varint и zigzag должны совпадать с protobuf: 300 - ac 02, int32 -1 - 10 байт, sint64 -1 - 01
+func TestCountersBytes(t *testing.T) {
+	long := string(bytes.Repeat([]byte{'x'}, 300))
+	in := Counters{
+		Hits:    300,
+		Level:   -1,
+		Delta:   -1,
+		Errors:  0,
+		Offsets: []int32{-2},
+		Name:    "hi",
+		Labels:  []string{long},
+	}
+	want := []byte{
+		0xac, 0x02, // Hits varint
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, // Level varint, отрицательное - 10 байт
+		0x01,       // Delta zigzag
+		0x00,       // Errors varint
+		0x01, 0x03, // Offsets: количество varint, -2 zigzag
+		0x02, 0x0d, 0x00, 0x00, 0x00, // Owner: версия varint и длина тела uint32
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 'h', 'i', // Name, длина varint
+		0x01, 0xac, 0x02, // Labels: количество varint, длина строки 300 varint
+	}
+	want = append(want, long...)
+
+	data, err := in.Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("Pack bytes mismatch:\nwant % x\ngot  % x", want, data)
+	}
+
+	out := Counters{}
+	if err := out.Unpack(want); err != nil {
+		t.Fatalf("Unpack error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Unpack mismatch:\nwant %#v\ngot  %#v", in, out)
+	}
+}
+
+func TestCountersBadVarint(t *testing.T) {
+	valid, err := (&Counters{}).Pack()
+	if err != nil {
+		t.Fatalf("Pack error: %v", err)
+	}
+	// 11 байт varint вместо Hits: у uint64 их не больше 10
+	data := append(bytes.Repeat([]byte{0x80}, 10), 0x01)
+	data = append(data, valid[1:]...)
+
+	out := Counters{}
+	if err := out.Unpack(data); !errors.Is(err, ErrBadValue) {
+		t.Errorf("want ErrBadValue, got %v", err)
+	}
+}
+
+func TestPackTemplates(t *testing.T) {
+	if UserPackTemplate != "V V/a* V" {
+		t.Errorf("UserPackTemplate: want %q, got %q", "V V/a* V", UserPackTemplate)
+	}
+	if LegacyEventPackTemplate != "n N/a* C v3 d> l> C N/n*" {
+		t.Errorf("LegacyEventPackTemplate: want %q, got %q", "n N/a* C v3 d> l> C N/n*", LegacyEventPackTemplate)
+	}
+}
+
+// байты ниже получены из perl, команды в комментариях
+func TestTemplateBytes(t *testing.T) {
+	// perl -e 'print unpack("H*", pack("V V/a* V", 1_123_456, "v.romanov", 16))'
+	user := &User{ID: 1123456, Login: "v.romanov", Flags: 16}
+	userWant := []byte{
+		0x80, 0x24, 0x11, 0x00,
+		0x09, 0x00, 0x00, 0x00, 'v', '.', 'r', 'o', 'm', 'a', 'n', 'o', 'v',
+		0x10, 0x00, 0x00, 0x00,
+	}
+
+	// perl -e 'print unpack("H*", pack("n N/a* C v3 d> l> C N/n*", 513, "hi", 7, 1, 2, 65535, 1.5, -2, 1, 80, 443))'
+	event := &LegacyEvent{Kind: 513, Payload: []byte("hi"), Flags: 7, Ports: [3]uint16{1, 2, 65535}, Score: 1.5, Delta: -2, Active: true, Hosts: []uint16{80, 443}}
+	eventWant := []byte{
+		0x02, 0x01,
+		0x00, 0x00, 0x00, 0x02, 'h', 'i',
+		0x07,
+		0x01, 0x00, 0x02, 0x00, 0xff, 0xff,
+		0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0xfe,
+		0x01,
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x50, 0x01, 0xbb,
+	}
+
+	cases := []struct {
+		In   Message
+		Out  Message
+		Want []byte
+	}{
+		{user, &User{}, userWant},
+		{event, &LegacyEvent{}, eventWant},
+	}
+	for idx, item := range cases {
+		data, err := item.In.AppendPack(nil)
+		if err != nil {
+			t.Fatalf("[%d] Pack error: %v", idx, err)
+		}
+		if !bytes.Equal(data, item.Want) {
+			t.Errorf("[%d] Pack bytes mismatch:\nwant % x\ngot  % x", idx, item.Want, data)
+		}
+		if err := item.Out.Unpack(item.Want); err != nil {
+			t.Fatalf("[%d] Unpack error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(item.In, item.Out) {
+			t.Errorf("[%d] Unpack mismatch:\nwant %#v\ngot  %#v", idx, item.In, item.Out)
+		}
+	}
+}
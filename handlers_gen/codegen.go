@@ -2,18 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"log"
+	"math"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	filePatchIn  = "api.go"
-	filePatchOut = "api_handlers.go"
+	filePatchIn   = "api.go"
+	filePatchOut  = "api_handlers.go"
+	filePatchDocs = "api_docs.md"
 )
+
+// значения max_body и read_timeout для методов, где они не заданы, меняются флагами генератора
+var (
+	defaultMaxBody     = "1MB"
+	defaultReadTimeout = "10s"
+)
+
+// knownMiddlewares - имена, которые код регистрирует через RegisterMiddleware; опечатка в "middleware"
+// из apigen:api иначе всплыла бы только 500 на каждый запрос к методу
+var knownMiddlewares = ""
+
 const (
 	validatorLabelRequired  = "required"
 	validatorLabelParamName = "paramname"
@@ -24,119 +43,239 @@ const (
 )
 
 const (
-	responseErrorFuncRaw = `func responseError(rw http.ResponseWriter, err error) {
+	responseErrorFuncRaw = `func responseError(rw http.ResponseWriter, r *http.Request, svc *apiService, err error) {
 	if err == nil {
 		return
 	}
+	recordError(r, err)
 
-	type CR map[string]interface{}
+	if svc.ErrorFormat == errorFormatProblem {
+		responseProblem(rw, r, svc, err)
+		return
+	}
 
-	apiErr, ok := err.(ApiError)
-	if ok {
-		rw.WriteHeader(apiErr.HTTPStatus)
+	encoder, mediaType, ok := svc.negotiate(r)
+	if !ok {
+		encoder, mediaType = jsonEncoder{}, jsonMediaType
 	}
-	responseMap := CR{"error": err.Error()}
-	response, _ := json.Marshal(responseMap)
+	response, encodeErr := encoder.Encode(responseEnvelope{Error: err.Error()})
+	if encodeErr != nil {
+		// не каждый формат умеет ошибки, binpack например кодирует только сами результаты
+		response, _ = jsonEncoder{}.Encode(responseEnvelope{Error: err.Error()})
+		mediaType = jsonMediaType
+	}
+	rw.Header().Set("Content-Type", mediaType)
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(asApiError(err).HTTPStatus)
 	rw.Write(response)
 }`
-	responseResultFuncRaw = `func responseResult(rw http.ResponseWriter, err error, result interface{}) {
-	type CR map[string]interface{}
-	textErr := ""
-
+	responseResultFuncRaw = `func responseResult(rw http.ResponseWriter, r *http.Request, svc *apiService, status int, result interface{}) {
+	encoder, mediaType, ok := svc.negotiate(r)
+	if !ok {
+		responseError(rw, r, svc, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: "not_acceptable", Err: errors.New("not acceptable")})
+		return
+	}
+	response, err := encoder.Encode(responseEnvelope{Response: result})
 	if err != nil {
-		textErr = err.Error()
+		var apiErr ApiError
+		if !errors.As(err, &apiErr) {
+			apiErr = ApiError{HTTPStatus: http.StatusInternalServerError, Code: "internal", Err: err}
+		}
+		responseError(rw, r, svc, apiErr)
+		return
 	}
 
-	responseMap := CR{
-		"error":    textErr,
-		"response": result,
+	if withHeaders, ok := result.(ResultHeaders); ok {
+		for key, values := range withHeaders.Headers() {
+			for _, value := range values {
+				rw.Header().Add(key, value)
+			}
+		}
 	}
-
-	response, err := json.Marshal(responseMap)
-	if err != nil {
-		fmt.Println(err)
+	if withStatus, ok := result.(ResultStatus); ok && withStatus.StatusCode() != 0 {
+		status = withStatus.StatusCode()
+	}
+	if withVersion, ok := result.(ResultVersion); ok && withVersion.Version() != "" {
+		rw.Header().Set("ETag", "\""+withVersion.Version()+"\"")
 	}
+
+	rw.Header().Set("Content-Type", mediaType)
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(status)
 	rw.Write(response)
 }`
 )
 
+// запуск из корня проекта:
+//
+//	go run ./handlers_gen             - api_handlers.go и api_docs.md
+//	go run ./handlers_gen -max_body=4MB -read_timeout=30s
+//	go run ./handlers_gen -middleware=audit,trace
+//	go run ./handlers_gen docs -format=html -out=api_docs.html
 func main() {
-	hc, err := NewHandlersCodegen(filePatchIn, filePatchOut)
+	flag.StringVar(&defaultMaxBody, "max_body", defaultMaxBody, "request body limit for methods without max_body")
+	flag.StringVar(&defaultReadTimeout, "read_timeout", defaultReadTimeout, "body read timeout for methods without read_timeout")
+	flag.StringVar(&knownMiddlewares, "middleware", knownMiddlewares, "comma-separated middleware names registered at runtime, \"middleware\" in apigen:api may use only them")
+	flag.Parse()
+	if _, err := parseByteSize(defaultMaxBody); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := parseTimeout(defaultReadTimeout); err != nil {
+		log.Fatalln(err)
+	}
+
+	hc, err := NewHandlersCodegen(filePatchIn)
 	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if flag.Arg(0) == "docs" {
+		docsFlags := flag.NewFlagSet("docs", flag.ExitOnError)
+		format := docsFlags.String("format", docsFormatMarkdown, "docs format: md or html")
+		outPatch := docsFlags.String("out", "", "output file, api_docs.<format> by default")
+		docsFlags.Parse(flag.Args()[1:])
+
+		if *outPatch == "" {
+			*outPatch = "api_docs." + *format
+		}
+		if err := hc.DocsWrite(*outPatch, *format); err != nil {
+			log.Fatalln(err)
+		}
 		return
 	}
-	hc.GenerateAndWrite()
+
+	if err := hc.GenerateAndWrite(filePatchOut); err != nil {
+		log.Fatalln(err)
+	}
+	// документация пересобирается вместе с обработчиками, чтобы не расходиться с ними
+	if err := hc.DocsWrite(filePatchDocs, docsFormatMarkdown); err != nil {
+		log.Fatalln(err)
+	}
 }
 
 type handlersCodegen struct {
 	filePatchIn            string
-	filePatchOut           string
 	sourceFileBuffer       []byte
 	baseNode               *ast.File
-	out                    *os.File
 	needsMethods           needsMethods
 	needsValidateStructMap needsValidateStructMap
+	needsServices          needsServices
+	binpackStructs         binpackStructs
+	structs                map[string]*ast.StructType
 }
 
-func NewHandlersCodegen(filePatchIn, filePatchOut string) (*handlersCodegen, error) {
+func NewHandlersCodegen(filePatchIn string) (*handlersCodegen, error) {
 	baseNode, err := parser.ParseFile(token.NewFileSet(), filePatchIn, nil, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
 
-	out, err := os.Create(filePatchOut)
-	if err != nil {
-		return nil, err
-	}
-
 	sourceFileBuffer, err := os.ReadFile(filePatchIn)
 	if err != nil {
 		return nil, err
 	}
 
-	return &handlersCodegen{
+	hc := &handlersCodegen{
 		filePatchIn:            filePatchIn,
-		filePatchOut:           filePatchOut,
 		sourceFileBuffer:       sourceFileBuffer,
 		baseNode:               baseNode,
-		out:                    out,
 		needsMethods:           needsMethods{},
 		needsValidateStructMap: needsValidateStructMap{},
-	}, err
-}
-
-func (hc *handlersCodegen) GenerateAndWrite() error {
-	hc.packageAndImportWrite()
+		needsServices:          needsServices{},
+		binpackStructs:         binpackStructs{},
+		structs:                map[string]*ast.StructType{},
+	}
 
-	for _, decl := range hc.baseNode.Decls {
-		if ok := hc.needsMethods.AddDecl(decl, hc.sourceFileBuffer); !ok {
+	for _, decl := range baseNode.Decls {
+		if ok := hc.needsMethods.AddDecl(decl, sourceFileBuffer); !ok {
 			hc.needsValidateStructMap.AddDecl(decl)
 		}
+		if err := hc.needsServices.AddDecl(decl); err != nil {
+			return nil, err
+		}
+		addStructDecl(hc.structs, decl)
+		hc.binpackStructs.AddDecl(decl)
+	}
+	if err := hc.needsMethods.checkMiddleware(knownMiddlewares); err != nil {
+		return nil, err
 	}
 
+	return hc, nil
+}
+
+func (hc *handlersCodegen) GenerateAndWrite(filePatchOut string) error {
+	out, err := os.Create(filePatchOut)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hc.packageAndImportWrite(out)
+
 	if len(hc.needsMethods) > 0 {
-		hc.needsMethods.MethodsWrapperWrite(hc.out, hc.sourceFileBuffer)
+		hc.needsServices.ServicesWrite(out, hc.needsMethods.sortedReceivers())
+		hc.needsMethods.MethodsWrapperWrite(out, hc.sourceFileBuffer, hc.binpackStructs)
 	}
 	if len(hc.needsValidateStructMap) > 0 {
-		hc.needsValidateStructMap.StructValidationWrite(hc.out, hc.sourceFileBuffer)
+		hc.needsValidateStructMap.StructValidationWrite(out, hc.sourceFileBuffer, hc.binpackStructs)
 	}
 	return nil
 }
 
-func (hc *handlersCodegen) packageAndImportWrite() {
-	fmt.Fprintln(hc.out, "package "+hc.baseNode.Name.Name)
-	fmt.Fprintln(hc.out)
-	fmt.Fprintln(hc.out, "import (")
-	fmt.Fprintln(hc.out, "\t\"encoding/json\"")
-	fmt.Fprintln(hc.out, "\t\"errors\"")
-	fmt.Fprintln(hc.out, "\t\"fmt\"")
-	fmt.Fprintln(hc.out, "\t\"net/http\"")
-	fmt.Fprintln(hc.out, "\t\"strconv\"")
-	fmt.Fprintln(hc.out, ")")
-	fmt.Fprintln(hc.out)
+func (hc *handlersCodegen) packageAndImportWrite(out *os.File) {
+	fmt.Fprintln(out, "package "+hc.baseNode.Name.Name)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "import (")
+	fmt.Fprintln(out, "\t\"errors\"")
+	fmt.Fprintln(out, "\t\"net/http\"")
+	fmt.Fprintln(out, "\t\"strconv\"")
+	fmt.Fprintln(out, ")")
+	fmt.Fprintln(out)
 	return
 }
 
+// addStructDecl запоминает все структуры файла - по ним документация строит форму ответа
+func addStructDecl(structs map[string]*ast.StructType, decl interface{}) {
+	genDecl, ok := decl.(*ast.GenDecl)
+	if !ok {
+		return
+	}
+	for _, spec := range genDecl.Specs {
+		typeSpec, ok := spec.(*ast.TypeSpec)
+		if !ok {
+			continue
+		}
+		if structType, ok := typeSpec.Type.(*ast.StructType); ok {
+			structs[typeSpec.Name.Name] = structType
+		}
+	}
+}
+
+// binpackStructs - структуры с // cgen: binpack, для них example/gen генерирует Unpack и AppendPack,
+// такие параметры принимаются ещё и телом application/x-binpack, а результаты так же отдаются
+type binpackStructs map[string]bool
+
+func (bs binpackStructs) AddDecl(decl interface{}) {
+	genDecl, ok := decl.(*ast.GenDecl)
+	if !ok || genDecl.Doc == nil || len(genDecl.Specs) != 1 {
+		return
+	}
+	typeSpec, ok := genDecl.Specs[0].(*ast.TypeSpec)
+	if !ok {
+		return
+	}
+	for _, comment := range genDecl.Doc.List {
+		if strings.HasPrefix(comment.Text, "// cgen: binpack") {
+			bs[typeSpec.Name.Name] = true
+		}
+	}
+}
+
+// has понимает и указатель - результаты методов обычно *Struct
+func (bs binpackStructs) has(typeName string) bool {
+	return bs[strings.TrimPrefix(typeName, "*")]
+}
+
 type needsValidateStructMap map[string]*ast.StructType
 
 func (nvs needsValidateStructMap) AddDecl(decl interface{}) bool {
@@ -167,116 +306,151 @@ func (nvs needsValidateStructMap) AddDecl(decl interface{}) bool {
 	return false
 }
 
-func (nvs needsValidateStructMap) StructValidationWrite(out *os.File, src []byte) {
-	for name, structDecl := range nvs {
+func (nvs needsValidateStructMap) StructValidationWrite(out *os.File, src []byte, binpack binpackStructs) {
+	names := make([]string, 0, len(nvs))
+	for name := range nvs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		structDecl := nvs[name]
 		if structDecl == nil {
 			return
 		}
-		firstSymReceiverName := getFirstSymFromString(name)
+		structValidationWrite(out, src, name, structDecl, true)
+		// параметры из binpack уже заполнены Unpack, остаётся только проверить их
+		if binpack[name] {
+			structValidationWrite(out, src, name, structDecl, false)
+		}
+	}
+}
+
+// structValidationWrite пишет FilingAndValidate, который берёт поля из формы, или Validate без формы
+func structValidationWrite(out *os.File, src []byte, name string, structDecl *ast.StructType, fromForm bool) {
+	firstSymReceiverName := getFirstSymFromString(name)
 
+	if fromForm {
 		fmt.Fprintf(out, "func (%s *%s) FilingAndValidate(r *http.Request) error {\n", firstSymReceiverName, name)
 		fmt.Fprintln(out, "\tvar err error")
-		fmt.Fprintln(out, "\tfmt.Println(err)")
+		fmt.Fprintln(out, "\t_ = err")
+	} else {
+		fmt.Fprintf(out, "func (%s *%s) Validate() error {\n", firstSymReceiverName, name)
+	}
 
-		for _, field := range structDecl.Fields.List {
-			fieldType := astFieldToString(src, field)
+	for _, field := range structDecl.Fields.List {
+		fieldType := astFieldToString(src, field)
+		paramName := strings.ToLower(field.Names[0].Name)
+		for _, keyValue := range getValitatorParams(field.Tag.Value) {
+			if keyValue.key == validatorLabelParamName {
+				paramName = keyValue.value
+			}
+		}
 
-			//заполнение полей
-			switch fieldType {
-			case "int":
-				fmt.Fprintf(out, "%s.%s,err = strconv.Atoi(r.FormValue(\"%s\"))\n", firstSymReceiverName, field.Names[0], strings.ToLower(field.Names[0].Name))
-				fmt.Fprintln(out, "if err != nil{")
-				fmt.Fprintln(out, "return errors.New(\"age must be int\")")
-				fmt.Fprintln(out, "}")
+		//заполнение полей
+		switch {
+		case !fromForm:
+		case fieldType == "int":
+			fmt.Fprintf(out, "%s.%s,err = strconv.Atoi(r.FormValue(\"%s\"))\n", firstSymReceiverName, field.Names[0], strings.ToLower(field.Names[0].Name))
+			fmt.Fprintln(out, "if err != nil{")
+			fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must be int\")}\n", paramName, strings.ToLower(field.Names[0].Name))
+			fmt.Fprintln(out, "}")
 
-			case "string":
-				fmt.Fprintf(out, "%s.%s = r.FormValue(\"%s\")\n", firstSymReceiverName, field.Names[0], strings.ToLower(field.Names[0].Name))
-			}
+		case fieldType == "string":
+			fmt.Fprintf(out, "%s.%s = r.FormValue(\"%s\")\n", firstSymReceiverName, field.Names[0], strings.ToLower(field.Names[0].Name))
+		}
 
-			validatorLabels := getValitatorParams(field.Tag.Value)
-			if validatorLabels == nil {
-				continue
-			}
+		validatorLabels := getValitatorParams(field.Tag.Value)
+		if validatorLabels == nil {
+			continue
+		}
 
-			//работа с параметрами валидатора
-			for _, keyValue := range validatorLabels {
+		//работа с параметрами валидатора
+		for _, keyValue := range validatorLabels {
 
-				switch keyValue.key {
-				case validatorLabelDefault:
-					switch fieldType {
-					case "string":
-						fmt.Fprintf(out, "if %s.%s == \"\"{\n", firstSymReceiverName, field.Names[0])
-						fmt.Fprintf(out, "%s.%s = \"%s\"\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintln(out, "}")
-					case "int":
-						fmt.Fprintf(out, "if %s.%s == 0{\n", firstSymReceiverName, field.Names[0])
-						fmt.Fprintf(out, "%s.%s,err = strconv.Atoi(r.FormValue(%s)\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintln(out, "if err != nil{")
-						fmt.Fprintln(out, "return errors.New(\"age must be int\")")
-						fmt.Fprintln(out, "}")
-					}
-				case validatorLabelParamName:
-					fmt.Fprintf(out, "%s.%s = r.FormValue(\"%s\")\n", firstSymReceiverName, field.Names[0], keyValue.value)
-				case validatorLabelEnum:
-					paramForErr := strings.ReplaceAll(keyValue.value, "|", ", ")
-					params := strings.Split(keyValue.value, "|")
-
-					fmt.Fprintln(out, "isTrue:=false")
-					for _, paramname := range params {
-						switch fieldType {
-						case "string":
-							fmt.Fprintf(out, "if %s.%s == \"%s\"{\n", firstSymReceiverName, field.Names[0], paramname)
-							fmt.Fprintln(out, "isTrue=true")
-							fmt.Fprintln(out, "}")
-						case "int":
-							fmt.Fprintf(out, "if %s.%s == strconv.Atoi(\"%s\"){\n", firstSymReceiverName, field.Names[0], paramname)
-							fmt.Fprintln(out, "isTrue=true")
-							fmt.Fprintln(out, "}")
-						}
-					}
-					fmt.Fprintln(out, "if !isTrue{")
-					fmt.Fprintf(out, "return errors.New(\"%s must be one of [%s]\")\n", strings.ToLower(field.Names[0].Name), paramForErr)
+			switch keyValue.key {
+			case validatorLabelDefault:
+				switch fieldType {
+				case "string":
+					fmt.Fprintf(out, "if %s.%s == \"\"{\n", firstSymReceiverName, field.Names[0])
+					fmt.Fprintf(out, "%s.%s = \"%s\"\n", firstSymReceiverName, field.Names[0], keyValue.value)
 					fmt.Fprintln(out, "}")
-				case validatorLabelMin:
-					switch fieldType {
-					case "string":
-						fmt.Fprintf(out, "if len(%s.%s) < %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintf(out, "return errors.New(\"%s len must be >= %s\")\n", strings.ToLower(field.Names[0].Name), keyValue.value)
-						fmt.Fprintln(out, "}")
-					case "int":
-						fmt.Fprintf(out, "if %s.%s < %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintf(out, "return errors.New(\"%s must be >= %s\")\n", strings.ToLower(field.Names[0].Name), keyValue.value)
+				case "int":
+					fmt.Fprintf(out, "if %s.%s == 0{\n", firstSymReceiverName, field.Names[0])
+					if !fromForm {
+						fmt.Fprintf(out, "%s.%s = %s\n", firstSymReceiverName, field.Names[0], keyValue.value)
 						fmt.Fprintln(out, "}")
+						continue
 					}
-				case validatorLabelMax:
+					fmt.Fprintf(out, "%s.%s,err = strconv.Atoi(r.FormValue(%s)\n", firstSymReceiverName, field.Names[0], keyValue.value)
+					fmt.Fprintln(out, "if err != nil{")
+					fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must be int\")}\n", paramName, strings.ToLower(field.Names[0].Name))
+					fmt.Fprintln(out, "}")
+				}
+			case validatorLabelParamName:
+				if !fromForm {
+					continue
+				}
+				fmt.Fprintf(out, "%s.%s = r.FormValue(\"%s\")\n", firstSymReceiverName, field.Names[0], keyValue.value)
+			case validatorLabelEnum:
+				paramForErr := strings.ReplaceAll(keyValue.value, "|", ", ")
+				params := strings.Split(keyValue.value, "|")
+
+				fmt.Fprintln(out, "isTrue:=false")
+				for _, paramname := range params {
 					switch fieldType {
 					case "string":
-						fmt.Fprintf(out, "if len(%s.%s) > %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintf(out, "return errors.New(\"%s len must be <= %s\")\n", strings.ToLower(field.Names[0].Name), keyValue.value)
+						fmt.Fprintf(out, "if %s.%s == \"%s\"{\n", firstSymReceiverName, field.Names[0], paramname)
+						fmt.Fprintln(out, "isTrue=true")
 						fmt.Fprintln(out, "}")
 					case "int":
-						fmt.Fprintf(out, "if %s.%s > %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
-						fmt.Fprintf(out, "return errors.New(\"%s must be <= %s\")\n", strings.ToLower(field.Names[0].Name), keyValue.value)
+						fmt.Fprintf(out, "if %s.%s == strconv.Atoi(\"%s\"){\n", firstSymReceiverName, field.Names[0], paramname)
+						fmt.Fprintln(out, "isTrue=true")
 						fmt.Fprintln(out, "}")
 					}
-				case validatorLabelRequired:
-					switch fieldType {
-					case "string":
-						fmt.Fprintf(out, "if %s.%s == \"\"{\n", firstSymReceiverName, field.Names[0])
-					case "int":
-						fmt.Fprintf(out, "if %s.%s == 0{\n", firstSymReceiverName, field.Names[0])
-					}
-
-					fmt.Fprintf(out, "return errors.New(\"%s must me not empty\")\n", strings.ToLower(field.Names[0].Name))
+				}
+				fmt.Fprintln(out, "if !isTrue{")
+				fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must be one of [%s]\")}\n", paramName, strings.ToLower(field.Names[0].Name), paramForErr)
+				fmt.Fprintln(out, "}")
+			case validatorLabelMin:
+				switch fieldType {
+				case "string":
+					fmt.Fprintf(out, "if len(%s.%s) < %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
+					fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s len must be >= %s\")}\n", paramName, strings.ToLower(field.Names[0].Name), keyValue.value)
+					fmt.Fprintln(out, "}")
+				case "int":
+					fmt.Fprintf(out, "if %s.%s < %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
+					fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must be >= %s\")}\n", paramName, strings.ToLower(field.Names[0].Name), keyValue.value)
+					fmt.Fprintln(out, "}")
+				}
+			case validatorLabelMax:
+				switch fieldType {
+				case "string":
+					fmt.Fprintf(out, "if len(%s.%s) > %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
+					fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s len must be <= %s\")}\n", paramName, strings.ToLower(field.Names[0].Name), keyValue.value)
+					fmt.Fprintln(out, "}")
+				case "int":
+					fmt.Fprintf(out, "if %s.%s > %s{\n", firstSymReceiverName, field.Names[0], keyValue.value)
+					fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must be <= %s\")}\n", paramName, strings.ToLower(field.Names[0].Name), keyValue.value)
 					fmt.Fprintln(out, "}")
 				}
+			case validatorLabelRequired:
+				switch fieldType {
+				case "string":
+					fmt.Fprintf(out, "if %s.%s == \"\"{\n", firstSymReceiverName, field.Names[0])
+				case "int":
+					fmt.Fprintf(out, "if %s.%s == 0{\n", firstSymReceiverName, field.Names[0])
+				}
+
+				fmt.Fprintf(out, "return ParamError{Param: %q, Err: errors.New(\"%s must me not empty\")}\n", paramName, strings.ToLower(field.Names[0].Name))
+				fmt.Fprintln(out, "}")
 			}
 		}
-
-		fmt.Fprintln(out, "\treturn nil")
-		fmt.Fprintln(out, "}")
-		fmt.Fprintln(out)
 	}
+
+	fmt.Fprintln(out, "\treturn nil")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out)
 }
 
 func getValitatorParams(tagValue string) (result []struct{ key, value string }) {
@@ -308,13 +482,24 @@ type needsMethods map[string][]needsMethod
 type needsMethod struct {
 	method       *ast.FuncDecl
 	methodParams paramCodegenMethod
+	description  string
 }
 
 type paramCodegenMethod struct {
-	Url        string `json:"url"`
-	Auth       bool   `json:"auth"`
-	Method     string `json:"method"`
-	PapaStruct string
+	Url          string   `json:"url"`
+	Auth         bool     `json:"auth"`
+	Method       string   `json:"method"`
+	Status       int      `json:"status"`
+	Middleware   []string `json:"middleware"`
+	RateLimit    string   `json:"rate_limit"`
+	RateLimitKey string   `json:"rate_limit_key"`
+	Idempotent   bool     `json:"idempotent"`
+	ETag         bool     `json:"etag"`
+	CacheControl string   `json:"cache_control"`
+	MaxBody      string   `json:"max_body"`
+	ReadTimeout  string   `json:"read_timeout"`
+	Compress     bool     `json:"compress"`
+	PapaStruct   string
 }
 
 func (nm needsMethods) AddDecl(decl interface{}, src []byte) bool {
@@ -325,45 +510,132 @@ func (nm needsMethods) AddDecl(decl interface{}, src []byte) bool {
 	if g.Doc == nil {
 		return false
 	}
+
+	// кроме строки apigen:api в комментарии может быть обычное описание метода - оно уходит в документацию
+	commentText := ""
+	description := make([]string, 0, len(g.Doc.List))
 	for _, dock := range g.Doc.List {
-		commentText := dock.Text
-		if !strings.HasPrefix(commentText, "// apigen:api") {
-			return false
+		if strings.HasPrefix(dock.Text, "// apigen:api") {
+			commentText = strings.ReplaceAll(dock.Text, "// apigen:api ", "")
+			continue
 		}
-		commentText = strings.ReplaceAll(commentText, "// apigen:api ", "")
+		description = append(description, strings.TrimSpace(strings.TrimPrefix(dock.Text, "//")))
+	}
+	if commentText == "" {
+		return false
+	}
 
-		paramCodegenMethod := paramCodegenMethod{}
-		json.Unmarshal([]byte(commentText), &paramCodegenMethod)
-		paramCodegenMethod.PapaStruct = astFieldToString(src, g.Recv.List[0])
-		nm[paramCodegenMethod.PapaStruct] = append(nm[paramCodegenMethod.PapaStruct], needsMethod{method: g, methodParams: paramCodegenMethod})
+	paramCodegenMethod := paramCodegenMethod{}
+	json.Unmarshal([]byte(commentText), &paramCodegenMethod)
+	paramCodegenMethod.PapaStruct = astFieldToString(src, g.Recv.List[0])
+	if _, _, err := parseRateLimit(paramCodegenMethod.RateLimit); err != nil {
+		log.Fatalf("%s.%s: %v", paramCodegenMethod.PapaStruct, g.Name.Name, err)
+	}
+	switch key := paramCodegenMethod.RateLimitKey; {
+	case key == "", key == "ip", key == "principal", strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+	default:
+		log.Fatalf("%s.%s: unknown rate_limit_key %q", paramCodegenMethod.PapaStruct, g.Name.Name, key)
+	}
+	if _, err := parseByteSize(paramCodegenMethod.MaxBody); err != nil {
+		log.Fatalf("%s.%s: %v", paramCodegenMethod.PapaStruct, g.Name.Name, err)
 	}
+	if _, err := parseTimeout(paramCodegenMethod.ReadTimeout); err != nil {
+		log.Fatalf("%s.%s: %v", paramCodegenMethod.PapaStruct, g.Name.Name, err)
+	}
+	nm[paramCodegenMethod.PapaStruct] = append(nm[paramCodegenMethod.PapaStruct], needsMethod{
+		method:       g,
+		methodParams: paramCodegenMethod,
+		description:  strings.TrimSpace(strings.Join(description, "\n")),
+	})
 	return true
 }
 
-func (nm needsMethods) MethodsWrapperWrite(out *os.File, src []byte) {
+// checkMiddleware проверяет имена "middleware" по списку из флага -middleware
+func (nm needsMethods) checkMiddleware(known string) error {
+	names := map[string]bool{}
+	for _, name := range strings.Split(known, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	for _, receiver := range nm.sortedReceivers() {
+		for _, m := range nm[receiver] {
+			for _, name := range m.methodParams.Middleware {
+				if !names[name] {
+					return fmt.Errorf("%s.%s: unknown middleware %q, list registered names in -middleware", receiver, m.method.Name.Name, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sortedReceivers нужен для стабильного порядка в сгенерированных файлах
+func (nm needsMethods) sortedReceivers() []string {
+	receivers := make([]string, 0, len(nm))
+	for receiver := range nm {
+		receivers = append(receivers, receiver)
+	}
+	sort.Strings(receivers)
+	return receivers
+}
+
+func (nm needsMethods) MethodsWrapperWrite(out *os.File, src []byte, binpack binpackStructs) {
+	nm.EndpointsWrite(out)
 	nm.ServeHttpGenerate(out)
 
-	for receiver, method := range nm {
+	for _, receiver := range nm.sortedReceivers() {
+		method := nm[receiver]
 		firstSymReceiverName := getFirstSymFromString(receiver)
 
 		for _, m := range method {
 
+			serviceVar := serviceVarName(receiver)
+
 			fmt.Fprintf(out, "func (%s %s) %s(rw http.ResponseWriter, r *http.Request) {\n", firstSymReceiverName, m.methodParams.PapaStruct, strings.ToLower(m.method.Name.Name))
 
+			// ограничение с ключом principal считается после проверки X-Auth, но до отказа в ней:
+			// так у выдуманного токена нет своего ведра, он расходует ведро адреса клиента
+			if m.methodParams.Auth {
+				fmt.Fprintln(out, "\tauthorized := r.Header.Get(\"X-Auth\") == \"100500\"")
+				fmt.Fprintln(out, "\tif authorized {")
+				fmt.Fprintf(out, "\t\tsetPrincipal(r, runtimeOf(%s).principal(r))\n", firstSymReceiverName)
+				fmt.Fprintln(out, "\t}")
+			}
+			fmt.Fprintf(out, "\tif !allowRequest(runtimeOf(%s), %s, rw, r, true) {\n", firstSymReceiverName, endpointVarName(receiver, m.method.Name.Name))
+			fmt.Fprintln(out, "\t\treturn")
+			fmt.Fprintln(out, "\t}")
 			if m.methodParams.Auth {
-				fmt.Fprintln(out, "\tif r.Header.Get(\"X-Auth\") != \"100500\" {")
-				fmt.Fprintln(out, "\t\tresponseError(rw, ApiError{HTTPStatus: http.StatusForbidden, Err: errors.New(\"unauthorized\")})")
+				fmt.Fprintln(out, "\tif !authorized {")
+				fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusForbidden, Code: \"unauthorized\", Err: errors.New(\"unauthorized\")})\n", serviceVar)
 				fmt.Fprintln(out, "\t\treturn")
 				fmt.Fprintln(out, "\t}")
 			}
 
 			if m.methodParams.Method != "" {
 				fmt.Fprintf(out, "\tif r.Method != \"%s\" {\n", m.methodParams.Method)
-				fmt.Fprintln(out, "\t\tresponseError(rw, ApiError{HTTPStatus: http.StatusNotAcceptable, Err: errors.New(\"bad method\")})")
+				fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: \"bad_method\", Err: errors.New(\"bad method\")})\n", serviceVar)
 				fmt.Fprintln(out, "\t\treturn")
 				fmt.Fprintln(out, "\t}")
 			}
 
+			// формат ответа проверяем до вызова метода, чтобы не выполнять его зря,
+			// binpack подходит только результатам, для которых он сгенерирован
+			if results := m.method.Type.Results; results != nil && len(results.List) > 0 && binpack.has(astFieldToString(src, results.List[0])) {
+				fmt.Fprintf(out, "\tif _, _, ok := %s.negotiate(r); !ok {\n", serviceVar)
+			} else {
+				fmt.Fprintf(out, "\tif _, mediaType, ok := %s.negotiate(r); !ok || mediaType == binpackMediaType {\n", serviceVar)
+			}
+			fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusNotAcceptable, Code: \"not_acceptable\", Err: errors.New(\"not acceptable\")})\n", serviceVar)
+			fmt.Fprintln(out, "\t\treturn")
+			fmt.Fprintln(out, "\t}")
+
+			// FormValue глотает ошибки чтения тела, поэтому форма разбирается заранее
+			fmt.Fprintln(out, "\tif err := r.ParseForm(); err != nil {")
+			fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, bodyError(err))\n", serviceVar)
+			fmt.Fprintln(out, "\t\treturn")
+			fmt.Fprintln(out, "\t}")
+
 			methodParamsSlice := make([]string, 0, 2)
 			for _, params := range m.method.Type.Params.List {
 				variableName := strings.ToLower(strings.ReplaceAll(astFieldToString(src, params), ".", ""))
@@ -375,8 +647,21 @@ func (nm needsMethods) MethodsWrapperWrite(out *os.File, src []byte) {
 				methodParamsSlice = append(methodParamsSlice, variableName)
 
 				fmt.Fprintf(out, "\t%s := %s{}\n", variableName, astFieldToString(src, params))
-				fmt.Fprintf(out, "\tif err := %s.FilingAndValidate(r); err != nil {\n", variableName)
-				fmt.Fprintln(out, "\t\tresponseError(rw, ApiError{HTTPStatus: http.StatusBadRequest,Err:err})")
+				if binpack.has(astFieldToString(src, params)) {
+					fmt.Fprintln(out, "\tif isBinpackRequest(r) {")
+					fmt.Fprintf(out, "\t\tif err := readBinpack(r, &%s); err != nil {\n", variableName)
+					fmt.Fprintf(out, "\t\t\tresponseError(rw, r, %s, err)\n", serviceVar)
+					fmt.Fprintln(out, "\t\t\treturn")
+					fmt.Fprintln(out, "\t\t}")
+					fmt.Fprintf(out, "\t\tif err := %s.Validate(); err != nil {\n", variableName)
+					fmt.Fprintf(out, "\t\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusBadRequest, Code: \"invalid_param\", Err: err})\n", serviceVar)
+					fmt.Fprintln(out, "\t\t\treturn")
+					fmt.Fprintln(out, "\t\t}")
+					fmt.Fprintf(out, "\t} else if err := %s.FilingAndValidate(r); err != nil {\n", variableName)
+				} else {
+					fmt.Fprintf(out, "\tif err := %s.FilingAndValidate(r); err != nil {\n", variableName)
+				}
+				fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusBadRequest, Code: \"invalid_param\", Err: err})\n", serviceVar)
 				fmt.Fprintln(out, "\t\treturn")
 				fmt.Fprintln(out, "\t}")
 			}
@@ -385,15 +670,14 @@ func (nm needsMethods) MethodsWrapperWrite(out *os.File, src []byte) {
 
 			fmt.Fprintf(out, "\tresponse, err := %s.%s(%s)\n", firstSymReceiverName, m.method.Name.Name, methodParamsString)
 			fmt.Fprintln(out, "\tif err != nil {")
-			fmt.Fprintln(out, "\t\tapiErr, ok := err.(ApiError)")
-			fmt.Fprintln(out, "\t\tif ok {")
-			fmt.Fprintln(out, "\t\t\tresponseError(rw, apiErr)")
-			fmt.Fprintln(out, "\t\t\treturn")
-			fmt.Fprintln(out, "\t\t}")
-			fmt.Fprintln(out, "\t\tresponseError(rw, ApiError{HTTPStatus: http.StatusInternalServerError, Err:err})")
+			fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, asApiError(err))\n", serviceVar)
 			fmt.Fprintln(out, "\t\treturn")
 			fmt.Fprintln(out, "\t}")
-			fmt.Fprintln(out, "\tresponseResult(rw, err, response)")
+			status := m.methodParams.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			fmt.Fprintf(out, "\tresponseResult(rw, r, %s, %d, response)\n", serviceVar, status)
 			fmt.Fprintln(out, "}")
 			fmt.Fprintln(out)
 		}
@@ -407,7 +691,8 @@ func (nm needsMethods) MethodsWrapperWrite(out *os.File, src []byte) {
 }
 
 func (nm needsMethods) ServeHttpGenerate(out *os.File) {
-	for receiver, method := range nm {
+	for _, receiver := range nm.sortedReceivers() {
+		method := nm[receiver]
 		firstSymReceiverName := getFirstSymFromString(receiver)
 
 		fmt.Fprintf(out, "func (%s %s) ServeHTTP(rw http.ResponseWriter, r *http.Request) {\n", firstSymReceiverName, receiver)
@@ -415,17 +700,272 @@ func (nm needsMethods) ServeHttpGenerate(out *os.File) {
 
 		for _, m := range method {
 			fmt.Fprintf(out, "\tcase \"%s\":\n", m.methodParams.Url)
-			fmt.Fprintf(out, "\t\t%s.%s(rw, r)\n", firstSymReceiverName, strings.ToLower(m.method.Name.Name))
+			fmt.Fprintf(out, "\t\tserveEndpoint(runtimeOf(%s), %s, http.HandlerFunc(%s.%s), rw, r)\n", firstSymReceiverName, endpointVarName(receiver, m.method.Name.Name), firstSymReceiverName, strings.ToLower(m.method.Name.Name))
 		}
 
 		fmt.Fprintln(out, "\tdefault:")
-		fmt.Fprintln(out, "\t\tresponseError(rw, ApiError{HTTPStatus:http.StatusNotFound,Err: errors.New(\"unknown method\")})")
+		fmt.Fprintf(out, "\t\tresponseError(rw, r, %s, ApiError{HTTPStatus: http.StatusNotFound, Code: \"unknown_method\", Err: errors.New(\"unknown method\")})\n", serviceVarName(receiver))
 		fmt.Fprintln(out, "\t}")
 		fmt.Fprintln(out, "}")
 		fmt.Fprintln(out)
 	}
 }
 
+// EndpointsWrite пишет описания методов - по ним serveEndpoint собирает цепочку middleware
+func (nm needsMethods) EndpointsWrite(out *os.File) {
+	for _, receiver := range nm.sortedReceivers() {
+		for _, m := range nm[receiver] {
+			fmt.Fprintf(out, "var %s = &apiEndpoint{\n", endpointVarName(receiver, m.method.Name.Name))
+			fmt.Fprintf(out, "\tService: %s,\n", serviceVarName(receiver))
+			fmt.Fprintf(out, "\tName: %q,\n", m.method.Name.Name)
+			fmt.Fprintf(out, "\tUrl: %q,\n", m.methodParams.Url)
+			if m.methodParams.Method != "" {
+				fmt.Fprintf(out, "\tMethods: %#v,\n", []string{m.methodParams.Method})
+			}
+			if len(m.methodParams.Middleware) > 0 {
+				fmt.Fprintf(out, "\tMiddleware: %#v,\n", m.methodParams.Middleware)
+			}
+			if m.methodParams.RateLimit != "" {
+				rate, burst, _ := parseRateLimit(m.methodParams.RateLimit)
+				key := m.methodParams.RateLimitKey
+				if key == "" {
+					key = "ip"
+				}
+				fmt.Fprintf(out, "\tRateLimit: &rateLimit{Rate: %s, Burst: %d, Key: %q},\n", strconv.FormatFloat(rate, 'g', -1, 64), burst, key)
+			}
+			if m.methodParams.Idempotent {
+				fmt.Fprintln(out, "\tIdempotent: true,")
+			}
+			if m.methodParams.ETag {
+				fmt.Fprintln(out, "\tETag: true,")
+			}
+			if m.methodParams.CacheControl != "" {
+				fmt.Fprintf(out, "\tCacheControl: %q,\n", m.methodParams.CacheControl)
+			}
+			if maxBody, _ := parseByteSize(m.methodParams.maxBody()); maxBody > 0 {
+				fmt.Fprintf(out, "\tMaxBody: %d, // %s\n", maxBody, m.methodParams.maxBody())
+			}
+			if readTimeout, _ := parseTimeout(m.methodParams.readTimeout()); readTimeout > 0 {
+				fmt.Fprintf(out, "\tReadTimeout: %d, // %s\n", readTimeout, readTimeout)
+			}
+			if m.methodParams.Compress {
+				fmt.Fprintln(out, "\tCompress: true,")
+			}
+			fmt.Fprintln(out, "}")
+			fmt.Fprintln(out)
+		}
+	}
+}
+
+type needsServices map[string]paramCodegenService
+
+// paramCodegenService - настройки получателя из комментария apigen:service над его типом
+type paramCodegenService struct {
+	ErrorFormat string            `json:"error_format"`
+	ProblemType string            `json:"problem_type"`
+	Encoders    []string          `json:"encoders"`
+	CORS        *paramCodegenCORS `json:"cors"`
+}
+
+type paramCodegenCORS struct {
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"expose_headers"`
+	Credentials   bool     `json:"credentials"`
+	MaxAge        int      `json:"max_age"`
+}
+
+func (ns needsServices) AddDecl(decl interface{}) error {
+	genDecl, ok := decl.(*ast.GenDecl)
+	if !ok {
+		return nil
+	}
+	for _, spec := range genDecl.Specs {
+		typeSpec, ok := spec.(*ast.TypeSpec)
+		if !ok {
+			continue
+		}
+
+		doc := typeSpec.Doc
+		if doc == nil {
+			doc = genDecl.Doc
+		}
+		if doc == nil {
+			continue
+		}
+
+		for _, comment := range doc.List {
+			if !strings.HasPrefix(comment.Text, "// apigen:service") {
+				continue
+			}
+			commentText := strings.TrimPrefix(comment.Text, "// apigen:service")
+
+			params := paramCodegenService{}
+			if err := json.Unmarshal([]byte(commentText), &params); err != nil {
+				return fmt.Errorf("%s: bad apigen:service: %v", typeSpec.Name.Name, err)
+			}
+			switch params.ErrorFormat {
+			case "", "legacy", "problem":
+			default:
+				return fmt.Errorf("%s: unknown error_format %q", typeSpec.Name.Name, params.ErrorFormat)
+			}
+			if params.CORS != nil && len(params.CORS.Origins) == 0 {
+				return fmt.Errorf("%s: cors without origins", typeSpec.Name.Name)
+			}
+			ns[typeSpec.Name.Name] = params
+		}
+	}
+	return nil
+}
+
+// ServicesWrite пишет описания получателей, с ними работают responseError и остальной рантайм
+func (ns needsServices) ServicesWrite(out *os.File, receivers []string) {
+	for _, receiver := range receivers {
+		name := strings.TrimLeft(receiver, "*")
+		params := ns[name]
+
+		fmt.Fprintf(out, "var %s = &apiService{\n", serviceVarName(receiver))
+		fmt.Fprintf(out, "\tName: %q,\n", name)
+		if params.ErrorFormat == "problem" {
+			fmt.Fprintln(out, "\tErrorFormat: errorFormatProblem,")
+		}
+		if params.ProblemType != "" {
+			fmt.Fprintf(out, "\tProblemType: %q,\n", params.ProblemType)
+		}
+		if len(params.Encoders) > 0 {
+			fmt.Fprintf(out, "\tEncoders: %#v,\n", params.Encoders)
+		}
+		if cors := params.CORS; cors != nil {
+			fmt.Fprintln(out, "\tCORS: &corsConfig{")
+			fmt.Fprintf(out, "\t\tOrigins: %#v,\n", cors.Origins)
+			if len(cors.Methods) > 0 {
+				fmt.Fprintf(out, "\t\tMethods: %#v,\n", cors.Methods)
+			}
+			if len(cors.Headers) > 0 {
+				fmt.Fprintf(out, "\t\tHeaders: %#v,\n", cors.Headers)
+			}
+			if len(cors.ExposeHeaders) > 0 {
+				fmt.Fprintf(out, "\t\tExposeHeaders: %#v,\n", cors.ExposeHeaders)
+			}
+			if cors.Credentials {
+				fmt.Fprintln(out, "\t\tCredentials: true,")
+			}
+			if cors.MaxAge > 0 {
+				fmt.Fprintf(out, "\t\tMaxAge: %d,\n", cors.MaxAge)
+			}
+			fmt.Fprintln(out, "\t},")
+		}
+		fmt.Fprintln(out, "}")
+		fmt.Fprintln(out)
+	}
+}
+
+// serviceVarName: *MyApi -> myApiService
+func serviceVarName(receiver string) string {
+	name := strings.TrimLeft(receiver, "*")
+	if name == "" {
+		return ""
+	}
+	return strings.ToLower(name[:1]) + name[1:] + "Service"
+}
+
+// parseRateLimit разбирает "10/s burst=20" в токены в секунду и размер ведра,
+// единицы - s, m, h; без burst ведро вмещает количество запросов за одну единицу времени
+func parseRateLimit(spec string) (rate float64, burst int, err error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+
+	fields := strings.Fields(spec)
+	count, unit, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad rate_limit %q, want like \"10/s burst=20\"", spec)
+	}
+	requests, err := strconv.ParseFloat(count, 64)
+	if err != nil || requests <= 0 {
+		return 0, 0, fmt.Errorf("bad rate_limit %q: requests must be positive number", spec)
+	}
+
+	switch unit {
+	case "s":
+		rate = requests
+	case "m":
+		rate = requests / 60
+	case "h":
+		rate = requests / 3600
+	default:
+		return 0, 0, fmt.Errorf("bad rate_limit %q: unknown unit %q", spec, unit)
+	}
+
+	burst = int(math.Ceil(requests))
+	for _, option := range fields[1:] {
+		value, found := strings.CutPrefix(option, "burst=")
+		if !found {
+			return 0, 0, fmt.Errorf("bad rate_limit %q: unknown option %q", spec, option)
+		}
+		if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("bad rate_limit %q: burst must be positive integer", spec)
+		}
+	}
+	return rate, burst, nil
+}
+
+func (pm paramCodegenMethod) maxBody() string {
+	if pm.MaxBody == "" {
+		return defaultMaxBody
+	}
+	return pm.MaxBody
+}
+
+func (pm paramCodegenMethod) readTimeout() string {
+	if pm.ReadTimeout == "" {
+		return defaultReadTimeout
+	}
+	return pm.ReadTimeout
+}
+
+// parseByteSize разбирает "512KB", "1MB" в байты, единицы двоичные; "unlimited" и "0" - без предела
+func parseByteSize(spec string) (int64, error) {
+	if spec == "" || spec == "0" || spec == "unlimited" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	for _, unit := range units {
+		number, found := strings.CutSuffix(strings.ToUpper(spec), unit.suffix)
+		if !found {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+		if err != nil || size <= 0 {
+			break
+		}
+		return size * unit.multiplier, nil
+	}
+	return 0, fmt.Errorf("bad max_body %q, want like \"1MB\"", spec)
+}
+
+// parseTimeout - длительность в формате time.ParseDuration, "0" - без дедлайна
+func parseTimeout(spec string) (time.Duration, error) {
+	if spec == "" || spec == "0" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(spec)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("bad read_timeout %q, want like \"10s\"", spec)
+	}
+	return timeout, nil
+}
+
+// endpointVarName: *MyApi, Profile -> myApiProfileEndpoint
+func endpointVarName(receiver, method string) string {
+	return strings.TrimSuffix(serviceVarName(receiver), "Service") + method + "Endpoint"
+}
+
 func astFieldToString(src []byte, field *ast.Field) string {
 	typeExpr := field.Type
 	start := typeExpr.Pos() - 1
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const middlewareApiSrc = `package main
+
+type ShopApi struct{}
+
+type OrderParams struct {
+	ID int ` + "`apivalidator:\"required\"`" + `
+}
+
+type Order struct {
+	ID int
+}
+
+// Order отдаёт заказ
+// apigen:api {"url": "/order", "middleware": ["audit", "trace"]}
+func (srv *ShopApi) Order(ctx context.Context, in OrderParams) (*Order, error) {
+	return &Order{ID: in.ID}, nil
+}
+`
+
+func TestMiddlewareAnnotation(t *testing.T) {
+	dir := t.TempDir()
+	apiPatch := filepath.Join(dir, "api.go")
+	if err := os.WriteFile(apiPatch, []byte(middlewareApiSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved string) { knownMiddlewares = saved }(knownMiddlewares)
+
+	cases := []struct {
+		Known string
+		Error string
+	}{
+		{Known: "audit, trace,metrics"},
+		{Known: "audit", Error: `*ShopApi.Order: unknown middleware "trace", list registered names in -middleware`},
+		{Known: "", Error: `*ShopApi.Order: unknown middleware "audit", list registered names in -middleware`},
+	}
+
+	for idx, item := range cases {
+		knownMiddlewares = item.Known
+		hc, err := NewHandlersCodegen(apiPatch)
+		if item.Error != "" {
+			if err == nil || err.Error() != item.Error {
+				t.Errorf("[%d] expected error %q, got %v", idx, item.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+
+		outPatch := filepath.Join(dir, "api_handlers.go")
+		if err := hc.GenerateAndWrite(outPatch); err != nil {
+			t.Fatalf("[%d] generate: %v", idx, err)
+		}
+		generated, _ := os.ReadFile(outPatch)
+		if expected := `Middleware: []string{"audit", "trace"},`; !strings.Contains(string(generated), expected) {
+			t.Errorf("[%d] endpoint without %s:\n%s", idx, expected, generated)
+		}
+	}
+}
+
+const problemApiSrc = `package main
+
+// apigen:service {"error_format": %q, "problem_type": "https://example.com/problems/"}
+type ShopApi struct{}
+
+type OrderParams struct {
+	ID int ` + "`apivalidator:\"required\"`" + `
+}
+
+type Order struct {
+	ID int
+}
+
+// Order отдаёт заказ
+// apigen:api {"url": "/order"}
+func (srv *ShopApi) Order(ctx context.Context, in OrderParams) (*Order, error) {
+	return &Order{ID: in.ID}, nil
+}
+`
+
+func TestErrorFormatAnnotation(t *testing.T) {
+	dir := t.TempDir()
+	apiPatch := filepath.Join(dir, "api.go")
+
+	cases := []struct {
+		Format   string
+		Expected []string
+		Error    string
+	}{
+		{Format: "problem", Expected: []string{"\tErrorFormat: errorFormatProblem,\n", "\tProblemType: \"https://example.com/problems/\",\n"}},
+		{Format: "legacy", Expected: []string{"\tProblemType: \"https://example.com/problems/\",\n"}},
+		{Format: "rfc7807", Error: `ShopApi: unknown error_format "rfc7807"`},
+	}
+
+	for idx, item := range cases {
+		if err := os.WriteFile(apiPatch, []byte(fmt.Sprintf(problemApiSrc, item.Format)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hc, err := NewHandlersCodegen(apiPatch)
+		if item.Error != "" {
+			if err == nil || err.Error() != item.Error {
+				t.Errorf("[%d] expected error %q, got %v", idx, item.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+
+		outPatch := filepath.Join(dir, "api_handlers.go")
+		if err := hc.GenerateAndWrite(outPatch); err != nil {
+			t.Fatalf("[%d] generate: %v", idx, err)
+		}
+		generated, _ := os.ReadFile(outPatch)
+		for _, expected := range item.Expected {
+			if !strings.Contains(string(generated), expected) {
+				t.Errorf("[%d] service without %q:\n%s", idx, expected, generated)
+			}
+		}
+		if item.Format != "problem" && strings.Contains(string(generated), "errorFormatProblem,") {
+			t.Errorf("[%d] %s service switched to problem+json", idx, item.Format)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	htmlTemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	docsFormatMarkdown = "md"
+	docsFormatHTML     = "html"
+)
+
+type docsService struct {
+	Name          string
+	ProblemErrors bool
+	Encoders      string
+	CORS          string
+	Endpoints     []docsEndpoint
+}
+
+type docsEndpoint struct {
+	Name            string
+	Url             string
+	Methods         string
+	Status          int
+	Auth            bool
+	Middleware      string
+	RateLimit       string
+	Idempotent      bool
+	Caching         string
+	Limits          string
+	Compress        bool
+	Description     string
+	ParamsType      string
+	Params          []docsParam
+	BinpackParams   bool
+	ResultType      string
+	BinpackResult   bool
+	ResponseFields  []docsField
+	ResponseExample string
+}
+
+type docsParam struct {
+	Name        string
+	Field       string
+	Type        string
+	Required    bool
+	Default     string
+	Constraints string
+}
+
+type docsField struct {
+	Name     string
+	JSONType string
+	GoType   string
+}
+
+var (
+	markdownDocsTpl = template.Must(template.New("markdownDocsTpl").Parse(`<!-- Code generated by handlers_gen from {{.Source}}. DO NOT EDIT. -->
+
+# API
+{{range .Services}}
+## {{.Name}}
+
+Форматы ответа по заголовку ` + "`Accept`" + `: {{.Encoders}}.
+{{if .CORS}}
+CORS: {{.CORS}}.
+{{end}}{{range .Endpoints}}
+### {{.Name}} - ` + "`{{.Url}}`" + `
+{{if .Description}}
+{{.Description}}
+{{end}}
+| | |
+|---|---|
+| Методы | {{.Methods}} |
+| Статус ответа | {{.Status}} |
+| Авторизация | {{if .Auth}}да, заголовок ` + "`X-Auth`" + `{{else}}нет{{end}} |
+{{if .Middleware}}| Middleware | {{.Middleware}} |
+{{end}}{{if .RateLimit}}| Ограничение частоты | {{.RateLimit}} |
+{{end}}{{if .Idempotent}}| Идемпотентность | заголовок ` + "`Idempotency-Key`" + `, повтор получает сохранённый ответ |
+{{end}}{{if .Caching}}| Кэширование | {{.Caching}} |
+{{end}}{{if .Limits}}| Тело запроса | {{.Limits}} |
+{{end}}{{if .Compress}}| Сжатие ответа | gzip или deflate по ` + "`Accept-Encoding`" + ` |
+{{end}}
+Параметры ` + "`{{.ParamsType}}`" + ` - query-строка или тело ` + "`application/x-www-form-urlencoded`" + `{{if .BinpackParams}} или ` + "`application/x-binpack`" + `{{end}}, тело можно сжать gzip или deflate:
+{{if .Params}}
+| Параметр | Поле | Тип | Обязательный | По умолчанию | Ограничения |
+|---|---|---|---|---|---|
+{{range .Params}}| ` + "`{{.Name}}`" + ` | {{.Field}} | {{.Type}} | {{if .Required}}да{{else}}нет{{end}} | {{.Default}} | {{.Constraints}} |
+{{end}}{{else}}
+нет
+{{end}}
+Ответ ` + "`{{.ResultType}}`" + `{{if .BinpackResult}}, с ` + "`Accept: application/x-binpack`" + ` - он же в binpack без обёртки{{end}}:
+{{if .ResponseFields}}
+| Поле | JSON | Go |
+|---|---|---|
+{{range .ResponseFields}}| ` + "`{{.Name}}`" + ` | {{.JSONType}} | {{.GoType}} |
+{{end}}{{end}}
+` + "```json" + `
+{{.ResponseExample}}
+` + "```" + `
+{{end}}
+{{if .ProblemErrors}}Ошибки {{.Name}} приходят в формате ` + "`application/problem+json`" + ` (RFC 7807).{{else}}Ошибки {{.Name}} приходят в виде ` + "`{\"error\": \"текст ошибки\"}`" + ` с соответствующим http-статусом.{{end}}
+{{end}}`))
+
+	htmlDocsTpl = htmlTemplate.Must(htmlTemplate.New("htmlDocsTpl").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API</title>
+<style>
+body { font-family: sans-serif; max-width: 960px; margin: 0 auto; }
+table { border-collapse: collapse; margin: 8px 0; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+pre { background: #f4f4f4; padding: 8px; }
+</style>
+</head>
+<body>
+<h1>API</h1>
+{{range .Services}}
+<h2>{{.Name}}</h2>
+<p>Форматы ответа по заголовку <code>Accept</code>: {{.Encoders}}.</p>
+{{if .CORS}}<p>CORS: {{.CORS}}.</p>{{end}}
+{{range .Endpoints}}
+<h3>{{.Name}} - <code>{{.Url}}</code></h3>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+<table>
+<tr><th>Методы</th><td>{{.Methods}}</td></tr>
+<tr><th>Статус ответа</th><td>{{.Status}}</td></tr>
+<tr><th>Авторизация</th><td>{{if .Auth}}да, заголовок <code>X-Auth</code>{{else}}нет{{end}}</td></tr>
+{{if .Middleware}}<tr><th>Middleware</th><td>{{.Middleware}}</td></tr>{{end}}
+{{if .RateLimit}}<tr><th>Ограничение частоты</th><td>{{.RateLimit}}</td></tr>{{end}}
+{{if .Idempotent}}<tr><th>Идемпотентность</th><td>заголовок <code>Idempotency-Key</code>, повтор получает сохранённый ответ</td></tr>{{end}}
+{{if .Caching}}<tr><th>Кэширование</th><td>{{.Caching}}</td></tr>{{end}}
+{{if .Limits}}<tr><th>Тело запроса</th><td>{{.Limits}}</td></tr>{{end}}
+{{if .Compress}}<tr><th>Сжатие ответа</th><td>gzip или deflate по <code>Accept-Encoding</code></td></tr>{{end}}
+</table>
+<p>Параметры <code>{{.ParamsType}}</code> - query-строка или тело <code>application/x-www-form-urlencoded</code>{{if .BinpackParams}} или <code>application/x-binpack</code>{{end}}, тело можно сжать gzip или deflate:</p>
+{{if .Params}}<table>
+<tr><th>Параметр</th><th>Поле</th><th>Тип</th><th>Обязательный</th><th>По умолчанию</th><th>Ограничения</th></tr>
+{{range .Params}}<tr><td><code>{{.Name}}</code></td><td>{{.Field}}</td><td>{{.Type}}</td><td>{{if .Required}}да{{else}}нет{{end}}</td><td>{{.Default}}</td><td>{{.Constraints}}</td></tr>
+{{end}}</table>{{else}}<p>нет</p>{{end}}
+<p>Ответ <code>{{.ResultType}}</code>{{if .BinpackResult}}, с <code>Accept: application/x-binpack</code> - он же в binpack без обёртки{{end}}:</p>
+{{if .ResponseFields}}<table>
+<tr><th>Поле</th><th>JSON</th><th>Go</th></tr>
+{{range .ResponseFields}}<tr><td><code>{{.Name}}</code></td><td>{{.JSONType}}</td><td>{{.GoType}}</td></tr>
+{{end}}</table>{{end}}
+<pre>{{.ResponseExample}}</pre>
+{{end}}
+{{if .ProblemErrors}}<p>Ошибки {{.Name}} приходят в формате <code>application/problem+json</code> (RFC 7807).</p>{{else}}<p>Ошибки {{.Name}} приходят в виде <code>{"error": "текст ошибки"}</code> с соответствующим http-статусом.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+)
+
+func (hc *handlersCodegen) DocsWrite(filePatchOut, format string) error {
+	if format != docsFormatMarkdown && format != docsFormatHTML {
+		return fmt.Errorf("unknown docs format %q", format)
+	}
+
+	out, err := os.Create(filePatchOut)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return hc.docsRender(out, format)
+}
+
+func (hc *handlersCodegen) docsRender(out io.Writer, format string) error {
+	data := struct {
+		Source   string
+		Services []docsService
+	}{
+		Source:   hc.filePatchIn,
+		Services: hc.docsCollect(),
+	}
+
+	if format == docsFormatHTML {
+		return htmlDocsTpl.Execute(out, data)
+	}
+	return markdownDocsTpl.Execute(out, data)
+}
+
+func (hc *handlersCodegen) docsCollect() []docsService {
+	services := make([]docsService, 0, len(hc.needsMethods))
+
+	for _, receiver := range hc.needsMethods.sortedReceivers() {
+		service := docsService{Name: strings.TrimPrefix(receiver, "*")}
+		service.ProblemErrors = hc.needsServices[service.Name].ErrorFormat == "problem"
+		service.Encoders = "все зарегистрированные, по умолчанию json"
+		if encoders := hc.needsServices[service.Name].Encoders; len(encoders) > 0 {
+			service.Encoders = strings.Join(encoders, ", ")
+		}
+		if cors := hc.needsServices[service.Name].CORS; cors != nil {
+			service.CORS = "источники " + strings.Join(cors.Origins, ", ")
+			if len(cors.Headers) > 0 {
+				service.CORS += ", заголовки " + strings.Join(cors.Headers, ", ")
+			}
+			if cors.Credentials {
+				service.CORS += ", с cookie и авторизацией"
+			}
+			if cors.MaxAge > 0 {
+				service.CORS += ", preflight кэшируется " + strconv.Itoa(cors.MaxAge) + " с"
+			}
+		}
+
+		for _, m := range hc.needsMethods[receiver] {
+			endpoint := docsEndpoint{
+				Name:        m.method.Name.Name,
+				Url:         m.methodParams.Url,
+				Methods:     m.methodParams.Method,
+				Status:      m.methodParams.Status,
+				Auth:        m.methodParams.Auth,
+				Middleware:  strings.Join(m.methodParams.Middleware, ", "),
+				Idempotent:  m.methodParams.Idempotent,
+				Compress:    m.methodParams.Compress,
+				Description: m.description,
+			}
+			if endpoint.Methods == "" {
+				endpoint.Methods = "любой"
+			}
+			if limit := m.methodParams.RateLimit; limit != "" {
+				key := m.methodParams.RateLimitKey
+				if key == "" {
+					key = "ip"
+				}
+				endpoint.RateLimit = limit + ", ключ " + key + ", при превышении 429 и Retry-After"
+			}
+			if m.methodParams.ETag {
+				endpoint.Caching = "ETag, If-None-Match отвечает 304"
+			}
+			if cacheControl := m.methodParams.CacheControl; cacheControl != "" {
+				if endpoint.Caching != "" {
+					endpoint.Caching += ", "
+				}
+				endpoint.Caching += "Cache-Control: " + cacheControl
+			}
+			if maxBody, _ := parseByteSize(m.methodParams.maxBody()); maxBody > 0 {
+				endpoint.Limits = "до " + m.methodParams.maxBody() + ", больше - 413"
+			}
+			if readTimeout, _ := parseTimeout(m.methodParams.readTimeout()); readTimeout > 0 {
+				if endpoint.Limits != "" {
+					endpoint.Limits += ", "
+				}
+				endpoint.Limits += "чтение не дольше " + readTimeout.String()
+			}
+			if endpoint.Status == 0 {
+				endpoint.Status = http.StatusOK
+			}
+
+			for _, param := range m.method.Type.Params.List {
+				paramsType := astFieldToString(hc.sourceFileBuffer, param)
+				if paramsType == "context.Context" {
+					continue
+				}
+				endpoint.ParamsType = paramsType
+				endpoint.Params = hc.docsParams(paramsType)
+				endpoint.BinpackParams = hc.binpackStructs.has(paramsType)
+			}
+
+			if results := m.method.Type.Results; results != nil && len(results.List) > 0 {
+				resultType := astFieldToString(hc.sourceFileBuffer, results.List[0])
+				endpoint.ResultType = resultType
+				endpoint.BinpackResult = hc.binpackStructs.has(resultType) && hc.serviceEncodes(service.Name, "binpack")
+				endpoint.ResponseFields = hc.docsFields(resultType, "")
+				endpoint.ResponseExample = "{\n\t\"error\": \"\",\n\t\"response\": " + hc.docsExample(resultType, "\t") + "\n}"
+			}
+
+			service.Endpoints = append(service.Endpoints, endpoint)
+		}
+
+		services = append(services, service)
+	}
+	return services
+}
+
+// serviceEncodes - есть ли формат среди "encoders" сервиса, пустой список - все зарегистрированные
+func (hc *handlersCodegen) serviceEncodes(service, encoder string) bool {
+	encoders := hc.needsServices[service].Encoders
+	if len(encoders) == 0 {
+		return true
+	}
+	for _, name := range encoders {
+		if name == encoder {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc *handlersCodegen) docsParams(paramsType string) []docsParam {
+	structType, ok := hc.structs[paramsType]
+	if !ok {
+		return nil
+	}
+
+	params := make([]docsParam, 0, len(structType.Fields.List))
+	for _, field := range structType.Fields.List {
+		if field.Tag == nil || len(field.Names) == 0 {
+			continue
+		}
+
+		param := docsParam{
+			Name:  strings.ToLower(field.Names[0].Name),
+			Field: field.Names[0].Name,
+			Type:  astFieldToString(hc.sourceFileBuffer, field),
+		}
+		constraints := make([]string, 0, 3)
+
+		for _, keyValue := range getValitatorParams(field.Tag.Value) {
+			switch keyValue.key {
+			case validatorLabelRequired:
+				param.Required = true
+			case validatorLabelParamName:
+				param.Name = keyValue.value
+			case validatorLabelDefault:
+				param.Default = keyValue.value
+			case validatorLabelEnum:
+				constraints = append(constraints, "одно из: "+strings.ReplaceAll(keyValue.value, "|", ", "))
+			case validatorLabelMin:
+				if param.Type == "string" {
+					constraints = append(constraints, "длина >= "+keyValue.value)
+				} else {
+					constraints = append(constraints, ">= "+keyValue.value)
+				}
+			case validatorLabelMax:
+				if param.Type == "string" {
+					constraints = append(constraints, "длина <= "+keyValue.value)
+				} else {
+					constraints = append(constraints, "<= "+keyValue.value)
+				}
+			}
+		}
+
+		// форма разбирает int через strconv.Atoi, пустое значение не пройдёт
+		if param.Type == "int" && param.Default == "" {
+			param.Required = true
+		}
+		param.Constraints = strings.Join(constraints, "; ")
+		params = append(params, param)
+	}
+	return params
+}
+
+// docsFields разворачивает поля ответа по json-тегам, вложенные структуры идут через точку
+func (hc *handlersCodegen) docsFields(typeName, prefix string) []docsField {
+	structType, ok := hc.structs[strings.TrimLeft(typeName, "*")]
+	if !ok {
+		return nil
+	}
+
+	fields := make([]docsField, 0, len(structType.Fields.List))
+	for _, field := range structType.Fields.List {
+		for _, name := range docsJSONNames(field) {
+			goType := astFieldToString(hc.sourceFileBuffer, field)
+			fields = append(fields, docsField{
+				Name:     prefix + name,
+				JSONType: hc.docsJSONType(goType),
+				GoType:   goType,
+			})
+
+			elemType := strings.TrimLeft(strings.TrimPrefix(goType, "[]"), "*")
+			if _, nested := hc.structs[elemType]; nested {
+				nestedPrefix := prefix + name + "."
+				if strings.HasPrefix(goType, "[]") {
+					nestedPrefix = prefix + name + "[]."
+				}
+				fields = append(fields, hc.docsFields(elemType, nestedPrefix)...)
+			}
+		}
+	}
+	return fields
+}
+
+func (hc *handlersCodegen) docsExample(typeName, indent string) string {
+	typeName = strings.TrimLeft(typeName, "*")
+
+	switch {
+	case strings.HasPrefix(typeName, "[]"):
+		return "[" + hc.docsExample(typeName[2:], indent) + "]"
+	case strings.HasPrefix(typeName, "map["):
+		return "{}"
+	}
+
+	structType, ok := hc.structs[typeName]
+	if !ok {
+		switch hc.docsJSONType(typeName) {
+		case "number":
+			return "0"
+		case "boolean":
+			return "false"
+		case "string":
+			return "\"\""
+		default:
+			return "null"
+		}
+	}
+
+	lines := make([]string, 0, len(structType.Fields.List))
+	for _, field := range structType.Fields.List {
+		for _, name := range docsJSONNames(field) {
+			goType := astFieldToString(hc.sourceFileBuffer, field)
+			lines = append(lines, indent+"\t"+strconv.Quote(name)+": "+hc.docsExample(goType, indent+"\t"))
+		}
+	}
+	if len(lines) == 0 {
+		return "{}"
+	}
+	return "{\n" + strings.Join(lines, ",\n") + "\n" + indent + "}"
+}
+
+func (hc *handlersCodegen) docsJSONType(goType string) string {
+	goType = strings.TrimLeft(goType, "*")
+
+	switch {
+	case strings.HasPrefix(goType, "[]"):
+		return "array"
+	case strings.HasPrefix(goType, "map["):
+		return "object"
+	}
+	if _, ok := hc.structs[goType]; ok {
+		return "object"
+	}
+
+	switch goType {
+	case "string":
+		return "string"
+	case "bool":
+		return "boolean"
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64",
+		"float32", "float64":
+		return "number"
+	default:
+		return "any"
+	}
+}
+
+// docsJSONNames - имена, под которыми поле попадёт в json (как у encoding/json)
+func docsJSONNames(field *ast.Field) []string {
+	jsonName := ""
+	if field.Tag != nil {
+		tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+		jsonName = strings.Split(tag.Get("json"), ",")[0]
+	}
+	if jsonName == "-" {
+		return nil
+	}
+
+	names := make([]string, 0, len(field.Names))
+	for _, name := range field.Names {
+		if !name.IsExported() {
+			continue
+		}
+		if jsonName != "" {
+			names = append(names, jsonName)
+			continue
+		}
+		names = append(names, name.Name)
+	}
+	return names
+}
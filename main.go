@@ -13,6 +13,7 @@ import (
 func main() {
 	// будет вызван метод ServeHTTP у структуры MyApi
 	http.Handle("/user/", NewMyApi())
+	http.Handle("/metrics", MetricsHandler())
 
 	fmt.Println("starting server at :8080")
 	http.ListenAndServe(":8080", nil)
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -21,12 +31,13 @@ var (
 )
 
 type Case struct {
-	Method string // GET по-умолчанию в http.NewRequest если передали пустую строку
-	Path   string
-	Query  string
-	Auth   bool
-	Status int
-	Result interface{}
+	Method  string // GET по-умолчанию в http.NewRequest если передали пустую строку
+	Path    string
+	Query   string
+	Auth    bool
+	Status  int
+	Headers map[string]string
+	Result  interface{}
 }
 
 const (
@@ -108,8 +119,11 @@ func TestMyApi(t *testing.T) {
 			Path:   ApiUserCreate,
 			Method: http.MethodPost,
 			Query:  "login=mr.moderator&age=32&status=moderator&full_name=Ivan_Ivanov",
-			Status: http.StatusOK,
+			Status: http.StatusCreated,
 			Auth:   true,
+			Headers: map[string]string{
+				"Location": "/user/profile?login=mr.moderator",
+			},
 			Result: CR{
 				"error": "",
 				"response": CR{
@@ -226,7 +240,7 @@ func TestMyApi(t *testing.T) {
 			Path:   ApiUserCreate,
 			Method: http.MethodPost,
 			Query:  "login=new_moderator3&age=32&full_name=Ivan_Ivanov",
-			Status: http.StatusOK,
+			Status: http.StatusCreated,
 			Auth:   true,
 			Result: CR{
 				"error": "",
@@ -323,6 +337,12 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 			continue
 		}
 
+		for key, value := range item.Headers {
+			if got := resp.Header.Get(key); got != value {
+				t.Errorf("[%s] expected header %s: %s, got %s", caseName, key, value, got)
+			}
+		}
+
 		err = json.Unmarshal(body, &result)
 		if err != nil {
 			t.Errorf("[%s] cant unpack json: %v", caseName, err)
@@ -342,3 +362,1083 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 		}
 	}
 }
+
+func TestProblemErrors(t *testing.T) {
+	myApiService.ErrorFormat = errorFormatProblem
+	myApiService.ProblemType = "https://example.com/problems/"
+	defer func() {
+		myApiService.ErrorFormat = errorFormatLegacy
+		myApiService.ProblemType = ""
+	}()
+
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Path     string
+		Query    string
+		Expected CR
+	}{
+		{ // ошибка валидации - параметр попадает в errors
+			Path:  ApiUserProfile,
+			Query: "",
+			Expected: CR{
+				"type":     "https://example.com/problems/invalid_param",
+				"title":    "Bad Request",
+				"status":   http.StatusBadRequest,
+				"detail":   "login must me not empty",
+				"instance": ApiUserProfile,
+				"code":     "invalid_param",
+				"errors": []CR{
+					{"param": "login", "detail": "login must me not empty"},
+				},
+			},
+		},
+		{ // ApiError с кодом из метода
+			Path:  ApiUserProfile,
+			Query: "login=not_exist_user",
+			Expected: CR{
+				"type":     "https://example.com/problems/user_not_found",
+				"title":    "Not Found",
+				"status":   http.StatusNotFound,
+				"detail":   "user not exist",
+				"instance": ApiUserProfile,
+				"code":     "user_not_found",
+			},
+		},
+	}
+
+	for idx, item := range cases {
+		resp, err := client.Get(ts.URL + item.Path + "?" + item.Query)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != problemContentType {
+			t.Errorf("[%d] expected content type %s, got %s", idx, problemContentType, ct)
+		}
+
+		var result, expected interface{}
+		json.Unmarshal(body, &result)
+		data, _ := json.Marshal(item.Expected)
+		json.Unmarshal(data, &expected)
+
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+	otherTs := httptest.NewServer(NewOtherApi())
+	defer otherTs.Close()
+
+	cases := []struct {
+		Method      string
+		URL         string
+		Accept      string
+		Status      int
+		ContentType string
+		Body        string
+	}{
+		{
+			URL:         ts.URL + ApiUserProfile + "?login=rvasily",
+			Accept:      "application/xml",
+			Status:      http.StatusOK,
+			ContentType: "application/xml",
+			Body:        "<result><error></error><response><id>42</id><login>rvasily</login><full_name>Vasily Romanov</full_name><status>20</status></response></result>",
+		},
+		{ // json предпочтительнее по q
+			URL:         ts.URL + ApiUserProfile + "?login=rvasily",
+			Accept:      "application/xml;q=0.5, application/*",
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        `{"error":"","response":{"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}}`,
+		},
+		{
+			URL:         ts.URL + ApiUserProfile + "?login=rvasily",
+			Accept:      "application/x-msgpack",
+			Status:      http.StatusOK,
+			ContentType: "application/x-msgpack",
+		},
+		{
+			URL:         ts.URL + ApiUserProfile + "?login=rvasily",
+			Accept:      "application/cbor",
+			Status:      http.StatusOK,
+			ContentType: "application/cbor",
+		},
+		{ // ошибки тоже в согласованном формате
+			URL:         ts.URL + ApiUserProfile + "?login=not_exist_user",
+			Accept:      "text/xml",
+			Status:      http.StatusNotFound,
+			ContentType: "text/xml",
+			Body:        "<result><error>user not exist</error></result>",
+		},
+		{
+			URL:         ts.URL + ApiUserProfile + "?login=rvasily",
+			Accept:      "text/html",
+			Status:      http.StatusNotAcceptable,
+			ContentType: "application/json",
+			Body:        `{"error":"not acceptable"}`,
+		},
+		{ // у OtherApi только json
+			Method:      http.MethodPost,
+			URL:         otherTs.URL + ApiUserCreate,
+			Accept:      "application/xml",
+			Status:      http.StatusNotAcceptable,
+			ContentType: "application/json",
+			Body:        `{"error":"not acceptable"}`,
+		},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(item.Method, item.URL, nil)
+		req.Header.Set("Accept", item.Accept)
+		req.Header.Set("X-Auth", "100500")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != item.ContentType {
+			t.Errorf("[%d] expected content type %s, got %s", idx, item.ContentType, ct)
+		}
+		if item.Body != "" && string(body) != item.Body {
+			t.Errorf("[%d] results not match\nGot: %s\nExpected: %s", idx, body, item.Body)
+		}
+	}
+}
+
+func TestBinaryEncoders(t *testing.T) {
+	value := struct {
+		ID   uint64   `json:"id"`
+		Name string   `json:"name,omitempty"`
+		Tags []string `json:"tags"`
+		Neg  int      `json:"neg"`
+		Skip int      `json:"-"`
+	}{ID: 300, Tags: []string{"a"}, Neg: -40, Skip: 1}
+
+	cases := []struct {
+		Encoder  Encoder
+		Expected []byte
+	}{
+		{
+			Encoder: msgpackEncoder{},
+			Expected: []byte{
+				0x83,
+				0xa2, 'i', 'd', 0xcd, 0x01, 0x2c,
+				0xa4, 't', 'a', 'g', 's', 0x91, 0xa1, 'a',
+				0xa3, 'n', 'e', 'g', 0xd0, 0xd8,
+			},
+		},
+		{
+			Encoder: cborEncoder{},
+			Expected: []byte{
+				0xa3,
+				0x62, 'i', 'd', 0x19, 0x01, 0x2c,
+				0x64, 't', 'a', 'g', 's', 0x81, 0x61, 'a',
+				0x63, 'n', 'e', 'g', 0x38, 0x27,
+			},
+		},
+	}
+
+	for idx, item := range cases {
+		got, err := item.Encoder.Encode(value)
+		if err != nil {
+			t.Errorf("[%d] encode error: %v", idx, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, item.Expected) {
+			t.Errorf("[%d] results not match\nGot: % x\nExpected: % x", idx, got, item.Expected)
+		}
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	// таблица общая для всего пакета, после теста она должна остаться как была
+	errorStatusesMu.RLock()
+	saved := append([]errorStatus{}, errorStatuses...)
+	errorStatusesMu.RUnlock()
+	t.Cleanup(func() {
+		errorStatusesMu.Lock()
+		errorStatuses = saved
+		errorStatusesMu.Unlock()
+	})
+
+	errPaymentRequired := errors.New("payment required")
+	RegisterErrorStatus(errPaymentRequired, http.StatusPaymentRequired, "payment_required")
+
+	cases := []struct {
+		Err    error
+		Status int
+		Code   string
+		Text   string
+	}{
+		{
+			Err:    fmt.Errorf("profile: %w", ApiError{HTTPStatus: http.StatusNotFound, Code: "user_not_found", Err: errors.New("user not exist")}),
+			Status: http.StatusNotFound,
+			Code:   "user_not_found",
+			Text:   "profile: user not exist",
+		},
+		{
+			Err:    &ApiError{HTTPStatus: http.StatusConflict, Code: "user_exists", Err: errors.New("user exist")},
+			Status: http.StatusConflict,
+			Code:   "user_exists",
+			Text:   "user exist",
+		},
+		{
+			Err:    fmt.Errorf("load user: %w", ErrNotFound),
+			Status: http.StatusNotFound,
+			Code:   "not_found",
+			Text:   "load user: not found",
+		},
+		{
+			Err:    fmt.Errorf("charge: %w", errPaymentRequired),
+			Status: http.StatusPaymentRequired,
+			Code:   "payment_required",
+			Text:   "charge: payment required",
+		},
+		{
+			Err:    errors.New("bad user"),
+			Status: http.StatusInternalServerError,
+			Code:   "internal",
+			Text:   "bad user",
+		},
+	}
+
+	for idx, item := range cases {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, ApiUserProfile, nil)
+		responseError(rw, r, myApiService, item.Err)
+
+		apiErr := asApiError(item.Err)
+		if apiErr.HTTPStatus != item.Status || apiErr.Code != item.Code {
+			t.Errorf("[%d] expected %d %s, got %d %s", idx, item.Status, item.Code, apiErr.HTTPStatus, apiErr.Code)
+		}
+		if rw.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rw.Code)
+		}
+		if expected := `{"error":"` + item.Text + `"}`; rw.Body.String() != expected {
+			t.Errorf("[%d] results not match\nGot: %s\nExpected: %s", idx, rw.Body.String(), expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	chainMiddleware := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Add("X-Chain", name)
+				next.ServeHTTP(rw, r)
+			})
+		}
+	}
+
+	GlobalRuntime.Use = []Middleware{chainMiddleware("global")}
+	myApiProfileEndpoint.Middleware = []string{"audit", "trace"}
+	defer func() {
+		GlobalRuntime.Use = nil
+		GlobalRuntime.Middlewares = nil
+		myApiProfileEndpoint.Middleware = nil
+	}()
+
+	api := NewMyApi()
+	api.Use = []Middleware{chainMiddleware("receiver")}
+	api.RegisterMiddleware("audit", chainMiddleware("audit"))
+	GlobalRuntime.RegisterMiddleware("trace", chainMiddleware("trace"))
+
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	expected := []string{"global", "receiver", "audit", "trace"}
+	if got := resp.Header.Values("X-Chain"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("middleware order not match\nGot: %v\nExpected: %v", got, expected)
+	}
+
+	// неизвестное имя - ошибка конфигурации, метод не вызывается
+	myApiProfileEndpoint.Middleware = []string{"unknown"}
+	resp, err = client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected http status %v, got %v", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if expected := `{"error":"unknown middleware \"unknown\""}`; string(body) != expected {
+		t.Errorf("results not match\nGot: %s\nExpected: %s", body, expected)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var (
+		panicEndpoint  string
+		panicRecovered interface{}
+	)
+
+	api := NewMyApi()
+	api.RegisterMiddleware("boom", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	})
+	api.OnPanic = func(r *http.Request, endpoint string, recovered interface{}, stack []byte) {
+		panicEndpoint = endpoint
+		panicRecovered = recovered
+	}
+
+	myApiCreateEndpoint.Middleware = []string{"boom"}
+	logOutput := &strings.Builder{}
+	log.SetOutput(logOutput)
+	defer func() {
+		myApiCreateEndpoint.Middleware = nil
+		log.SetOutput(os.Stderr)
+	}()
+
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	resp, err := client.Post(ts.URL+ApiUserCreate, "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected http status %v, got %v", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if expected := `{"error":"internal error"}`; string(body) != expected {
+		t.Errorf("results not match\nGot: %s\nExpected: %s", body, expected)
+	}
+	if panicEndpoint != "MyApi.Create" || panicRecovered != "boom" {
+		t.Errorf("panic hook got %s %v", panicEndpoint, panicRecovered)
+	}
+	if !strings.Contains(logOutput.String(), "panic in MyApi.Create") {
+		t.Errorf("panic not logged: %s", logOutput.String())
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logOutput := &bytes.Buffer{}
+	api := NewMyApi()
+	api.Logger = slog.New(slog.NewJSONHandler(logOutput, nil))
+
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader("age=32"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("X-Auth", "100500")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(logOutput.Bytes(), &record); err != nil {
+		t.Fatalf("cant unpack log record %q: %v", logOutput.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"level":            "WARN",
+		"msg":              "request",
+		"endpoint":         "MyApi.Create",
+		"method":           http.MethodPost,
+		"path":             ApiUserCreate,
+		"status":           float64(http.StatusBadRequest),
+		"size":             float64(len(body)),
+		"principal":        defaultPrincipal(req),
+		"validation_error": "login must me not empty",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("log record %s: expected %v, got %v", key, value, record[key])
+		}
+	}
+	if _, ok := record["latency"]; !ok {
+		t.Errorf("log record has no latency: %v", record)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	api := NewMyApi()
+	api.Metrics = NewMetrics([]float64{1, 5})
+
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	for _, query := range []string{"login=rvasily", "login=rvasily", "login=not_exist_user"} {
+		resp, err := client.Get(ts.URL + ApiUserProfile + "?" + query)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	rw := httptest.NewRecorder()
+	api.Metrics.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposition := rw.Body.String()
+
+	expectedLines := []string{
+		"# TYPE apigen_requests_total counter",
+		`apigen_requests_total{receiver="MyApi",endpoint="/user/profile",method="GET",status="200"} 2`,
+		`apigen_requests_total{receiver="MyApi",endpoint="/user/profile",method="GET",status="404"} 1`,
+		"# TYPE apigen_request_duration_seconds histogram",
+		`apigen_request_duration_seconds_bucket{receiver="MyApi",endpoint="/user/profile",method="GET",status="200",le="1"} 2`,
+		`apigen_request_duration_seconds_bucket{receiver="MyApi",endpoint="/user/profile",method="GET",status="200",le="+Inf"} 2`,
+		`apigen_request_duration_seconds_count{receiver="MyApi",endpoint="/user/profile",method="GET",status="404"} 1`,
+		"# TYPE apigen_requests_in_flight gauge",
+		`apigen_requests_in_flight{receiver="MyApi",endpoint="/user/profile",method="GET"} 0`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("metrics has no line %s\nGot:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2022, 5, 25, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	api := NewMyApi()
+	api.RateLimitStore = store
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	get := func() *http.Response {
+		resp, err := client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// "10/s burst=20" - ведро на 20 запросов
+	for i := 0; i < 20; i++ {
+		if resp := get(); resp.StatusCode != http.StatusOK {
+			t.Fatalf("[%d] expected http status %v, got %v", i, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	resp := get()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected http status %v, got %v", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After 1, got %q", retryAfter)
+	}
+
+	// за 100ms набегает ровно один токен
+	now = now.Add(100 * time.Millisecond)
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected http status %v after refill, got %v", http.StatusOK, resp.StatusCode)
+	}
+	if resp := get(); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected http status %v, got %v", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	// ключ principal: ведро у токена только после авторизации, выдуманные токены делят ведро адреса
+	myApiCreateEndpoint.RateLimit = &rateLimit{Rate: 1, Burst: 2, Key: rateLimitKeyPrincipal}
+	defer func() { myApiCreateEndpoint.RateLimit = nil }()
+
+	post := func(token, login string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader("login="+login+"&age=32"))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("X-Auth", token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	principalCases := []struct {
+		Token  string
+		Status int
+	}{
+		{"100500", http.StatusCreated},
+		{"fake-token-1", http.StatusForbidden},
+		{"100500", http.StatusCreated},
+		{"fake-token-2", http.StatusForbidden},
+		{"100500", http.StatusTooManyRequests},
+		{"fake-token-3", http.StatusTooManyRequests},
+	}
+	for idx, item := range principalCases {
+		if status := post(item.Token, fmt.Sprintf("rate_limited_user_%d", idx)); status != item.Status {
+			t.Errorf("[%d] %s: expected http status %v, got %v", idx, item.Token, item.Status, status)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, ApiUserProfile, nil)
+	req.Header.Set("X-Auth", "100500")
+	if principal := defaultPrincipal(req); len(principal) != len("x-auth:")+64 {
+		t.Errorf("principal must carry the whole sha256, got %q", principal)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	now := time.Date(2022, 5, 25, 12, 0, 0, 0, time.UTC)
+	rateStore := NewMemoryRateLimitStore()
+	rateStore.now = func() time.Time { return now }
+
+	api := NewMyApi()
+	api.RateLimitStore = rateStore
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	accept := ""
+	post := func(key, query string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader(query))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("X-Auth", "100500")
+		if accept != "" {
+			req.Header.Add("Accept", accept)
+		}
+		if key != "" {
+			req.Header.Add(idempotencyKeyHeader, key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	query := "login=idempotent_user&age=32"
+	created := `{"error":"","response":{"id":43}}`
+
+	resp, body := post("key-1", query)
+	if resp.StatusCode != http.StatusCreated || body != created {
+		t.Fatalf("first create: %d %s", resp.StatusCode, body)
+	}
+
+	// повтор после обрыва связи - тот же ответ, метод второй раз не вызывается
+	resp, body = post("key-1", query)
+	if resp.StatusCode != http.StatusCreated || body != created {
+		t.Errorf("replay: expected %d %s, got %d %s", http.StatusCreated, created, resp.StatusCode, body)
+	}
+	if resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay has no Idempotent-Replayed header")
+	}
+	if location := resp.Header.Get("Location"); location != "/user/profile?login=idempotent_user" {
+		t.Errorf("replay lost Location header: %q", location)
+	}
+
+	// тот же ключ с другим запросом
+	resp, body = post("key-1", "login=other_idempotent_user&age=32")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: expected %d, got %d %s", http.StatusUnprocessableEntity, resp.StatusCode, body)
+	}
+
+	// без ключа всё как раньше
+	resp, body = post("", query)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("without key: expected %d, got %d %s", http.StatusConflict, resp.StatusCode, body)
+	}
+
+	// ответ в binpack не отдаётся повторно клиенту, который ждёт json
+	accept = binpackMediaType
+	resp, body = post("key-2", "login=idempotent_binpack&age=32")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != binpackMediaType {
+		t.Fatalf("binpack create: %d %q", resp.StatusCode, body)
+	}
+	accept = ""
+	resp, body = post("key-2", "login=idempotent_binpack&age=32")
+	if resp.StatusCode != http.StatusUnprocessableEntity || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("binpack key with json: expected %d, got %d %s", http.StatusUnprocessableEntity, resp.StatusCode, body)
+	}
+
+	// 429 от лимита по principal случается внутри обёртки, но метод не вызывался - ключ свободен для повтора
+	myApiCreateEndpoint.RateLimit = &rateLimit{Rate: 1, Burst: 1, Key: rateLimitKeyPrincipal}
+	defer func() { myApiCreateEndpoint.RateLimit = nil }()
+
+	if resp, body = post("key-3", "login=idempotent_limited_1&age=32"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("limited create: %d %s", resp.StatusCode, body)
+	}
+	if resp, body = post("key-4", "login=idempotent_limited_2&age=32"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("limited create: expected %d, got %d %s", http.StatusTooManyRequests, resp.StatusCode, body)
+	}
+	now = now.Add(time.Second)
+	resp, body = post("key-4", "login=idempotent_limited_2&age=32")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after 429: expected %d, got %d %s", http.StatusCreated, resp.StatusCode, body)
+	}
+}
+
+type versionedResult struct {
+	ID int `json:"id"`
+}
+
+func (vr versionedResult) Version() string {
+	return fmt.Sprintf("v%d", vr.ID)
+}
+
+type acceptedResult struct {
+	ID     int `json:"id"`
+	Status int `json:"-"`
+}
+
+func (ar acceptedResult) StatusCode() int {
+	return ar.Status
+}
+
+// статус из результата важнее статуса из аннотации, ноль оставляет статус аннотации
+func TestResultStatus(t *testing.T) {
+	cases := []struct {
+		Result   acceptedResult
+		Expected int
+	}{
+		{acceptedResult{ID: 1, Status: http.StatusAccepted}, http.StatusAccepted},
+		{acceptedResult{ID: 2}, http.StatusCreated},
+	}
+	for idx, item := range cases {
+		rec := httptest.NewRecorder()
+		responseResult(rec, httptest.NewRequest(http.MethodPost, "/", nil), myApiService, http.StatusCreated, item.Result)
+		if rec.Code != item.Expected {
+			t.Errorf("[%d] expected http status %d, got %d", idx, item.Expected, rec.Code)
+		}
+		if expected := fmt.Sprintf(`{"error":"","response":{"id":%d}}`, item.Result.ID); rec.Body.String() != expected {
+			t.Errorf("[%d] expected body %s, got %s", idx, expected, rec.Body.String())
+		}
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	get := func(login, ifNoneMatch string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login="+login, nil)
+		if ifNoneMatch != "" {
+			req.Header.Add("If-None-Match", ifNoneMatch)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, _ := get("rvasily", "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", resp.StatusCode, etag)
+	}
+	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "private, max-age=60" {
+		t.Errorf("bad Cache-Control %q", cacheControl)
+	}
+
+	resp, body := get("rvasily", etag)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("expected 304 without body, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") != etag || resp.Header.Get("Cache-Control") == "" {
+		t.Errorf("304 must keep ETag and Cache-Control, got %v", resp.Header)
+	}
+
+	resp, _ = get("rvasily", `W/"stale", `+etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("list in If-None-Match: expected 304, got %d", resp.StatusCode)
+	}
+
+	resp, _ = get("not_exist_user", etag)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("ETag") != "" || resp.Header.Get("Cache-Control") != "" {
+		t.Errorf("errors must not be cached: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// версия из результата важнее хэша тела
+	handler := conditional(&apiEndpoint{Service: myApiService, ETag: true}, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		responseResult(rw, r, myApiService, http.StatusOK, versionedResult{ID: 7})
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if etag := rec.Header().Get("ETag"); etag != `"v7"` {
+		t.Errorf("expected ETag from Version(), got %q", etag)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", `"v7"`)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for Version() ETag, got %d", rec.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	do := func(method, path string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	origin := "https://app.example.com"
+	resp := do(http.MethodOptions, ApiUserCreate, map[string]string{
+		"Origin":                         origin,
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "x-auth, content-type",
+	})
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      origin,
+		"Access-Control-Allow-Methods":     "POST",
+		"Access-Control-Allow-Headers":     "Content-Type, X-Auth, Idempotency-Key",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("preflight: expected %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	for key, value := range expected {
+		if got := resp.Header.Get(key); got != value {
+			t.Errorf("preflight %s: expected %q, got %q", key, value, got)
+		}
+	}
+
+	// метод, которого нет у эндпоинта, и чужой источник не получают разрешения
+	resp = do(http.MethodOptions, ApiUserCreate, map[string]string{"Origin": origin, "Access-Control-Request-Method": "PUT"})
+	if resp.Header.Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("PUT must not be allowed for %s", ApiUserCreate)
+	}
+	resp = do(http.MethodOptions, ApiUserCreate, map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "POST"})
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unknown origin must not be allowed")
+	}
+
+	// эндпоинт без "method" разрешает методы по умолчанию
+	resp = do(http.MethodOptions, ApiUserProfile, map[string]string{"Origin": origin, "Access-Control-Request-Method": "GET"})
+	if methods := resp.Header.Get("Access-Control-Allow-Methods"); methods != "GET, HEAD, POST" {
+		t.Errorf("profile preflight methods: %q", methods)
+	}
+
+	// обычный запрос
+	resp = do(http.MethodGet, ApiUserProfile+"?login=rvasily", map[string]string{"Origin": origin})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != origin {
+		t.Errorf("simple request: %d %v", resp.StatusCode, resp.Header)
+	}
+	if expose := resp.Header.Get("Access-Control-Expose-Headers"); expose != "Location, ETag" {
+		t.Errorf("expose headers: %q", expose)
+	}
+	if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Origin") {
+		t.Errorf("response must vary by Origin: %v", resp.Header.Values("Vary"))
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	post := func(body io.Reader, contentLength int64) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, body)
+		req.ContentLength = contentLength
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(respBody)
+	}
+
+	large := "login=large_body_user&age=32&full_name=" + strings.Repeat("a", 64<<10)
+	expected := `{"error":"request body too large"}`
+
+	// размер известен заранее - отказ до чтения тела
+	resp, body := post(strings.NewReader(large), int64(len(large)))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || body != expected {
+		t.Errorf("with Content-Length: expected %d %s, got %d %s", http.StatusRequestEntityTooLarge, expected, resp.StatusCode, body)
+	}
+
+	// chunked - предел срабатывает при чтении
+	resp, body = post(io.MultiReader(strings.NewReader(large)), -1)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || body != expected {
+		t.Errorf("chunked: expected %d %s, got %d %s", http.StatusRequestEntityTooLarge, expected, resp.StatusCode, body)
+	}
+
+	query := "login=small_body_user&age=32"
+	resp, body = post(strings.NewReader(query), int64(len(query)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("small body: expected %d, got %d %s", http.StatusCreated, resp.StatusCode, body)
+	}
+
+	if myApiProfileEndpoint.MaxBody != 1<<20 || myApiProfileEndpoint.ReadTimeout != 10*time.Second {
+		t.Errorf("generator defaults are not applied: %d %v", myApiProfileEndpoint.MaxBody, myApiProfileEndpoint.ReadTimeout)
+	}
+
+	// read_timeout: тело не дослали - 408, следующий запрос на том же соединении работает как обычно
+	saved := myApiCreateEndpoint.ReadTimeout
+	myApiCreateEndpoint.ReadTimeout = 50 * time.Millisecond
+	defer func() { myApiCreateEndpoint.ReadTimeout = saved }()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(body string, contentLength int) (*http.Response, string) {
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: test\r\nX-Auth: 100500\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\n\r\n%s", ApiUserCreate, contentLength, body)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("response error: %v", err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(respBody)
+	}
+
+	query = "login=keep_alive_user&age=32"
+	if resp, body = send(query, len(query)); resp.StatusCode != http.StatusCreated {
+		t.Errorf("keep-alive: expected %d, got %d %s", http.StatusCreated, resp.StatusCode, body)
+	}
+
+	expected = `{"error":"request body read timeout"}`
+	if resp, body = send("login=slow", 100); resp.StatusCode != http.StatusRequestTimeout || body != expected {
+		t.Errorf("slow body: expected %d %s, got %d %s", http.StatusRequestTimeout, expected, resp.StatusCode, body)
+	}
+
+	// дочитанное тело снимает дедлайн, иначе он остался бы на соединении и после чтения
+	rw := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodPost, ApiUserCreate, strings.NewReader(query))
+	limitRequest(myApiCreateEndpoint, rw, r)
+	if len(rw.deadlines) != 1 || rw.deadlines[0].IsZero() {
+		t.Fatalf("expected read deadline, got %v", rw.deadlines)
+	}
+	io.ReadAll(r.Body)
+	if len(rw.deadlines) != 2 || !rw.deadlines[1].IsZero() {
+		t.Errorf("read deadline must be cleared after the body, got %v", rw.deadlines)
+	}
+}
+
+// deadlineRecorder запоминает дедлайны, которые выставляет http.ResponseController
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (dr *deadlineRecorder) SetReadDeadline(deadline time.Time) error {
+	dr.deadlines = append(dr.deadlines, deadline)
+	return nil
+}
+
+func TestCompression(t *testing.T) {
+	api := NewMyApi()
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	get := func(acceptEncoding, ifNoneMatch string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	plain := `{"error":"","response":{"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}}`
+
+	// ответ меньше порога по умолчанию не сжимается
+	resp, body := get("gzip", "")
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != plain {
+		t.Errorf("small response must not be compressed: %v %s", resp.Header, body)
+	}
+	if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Accept-Encoding") {
+		t.Errorf("response must vary by Accept-Encoding: %v", resp.Header.Values("Vary"))
+	}
+
+	api.CompressMinSize = 1
+	resp, body = get("deflate;q=0.5, gzip", "")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("bad gzip: %v", err)
+	}
+	if unpacked, _ := io.ReadAll(reader); string(unpacked) != plain {
+		t.Errorf("gzip body mismatch: %s", unpacked)
+	}
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("compressed response must have weak ETag, got %q", etag)
+	}
+	if resp, _ = get("gzip", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("weak ETag: expected 304, got %d", resp.StatusCode)
+	}
+
+	resp, body = get("deflate", "")
+	if resp.Header.Get("Content-Encoding") != "deflate" {
+		t.Fatalf("expected deflate, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	zreader, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("bad deflate: %v", err)
+	}
+	if unpacked, _ := io.ReadAll(zreader); string(unpacked) != plain {
+		t.Errorf("deflate body mismatch: %s", unpacked)
+	}
+
+	if resp, _ = get("gzip;q=0, identity", ""); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("gzip;q=0 must disable compression")
+	}
+
+	// сжатое тело запроса
+	post := func(encoding string, body []byte) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, bytes.NewReader(body))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Content-Encoding", encoding)
+		req.Header.Add("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	packed := bytes.Buffer{}
+	writer := gzip.NewWriter(&packed)
+	writer.Write([]byte("login=gzipped_user&age=32"))
+	writer.Close()
+	if resp = post("gzip", packed.Bytes()); resp.StatusCode != http.StatusCreated {
+		t.Errorf("gzip body: expected %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp = post("gzip", []byte("login=not_gzipped")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("broken gzip: expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if resp = post("br", []byte("login=brotli")); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: expected %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
+
+func TestBinpackBodies(t *testing.T) {
+	api := NewMyApi()
+	// статус без default дошёл бы до Create пустым и стал бы -1, а не statuses["user"]
+	api.statuses[""] = -1
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	do := func(method, path string, body []byte, accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if body != nil {
+			req.Header.Add("Content-Type", binpackMediaType)
+		}
+		req.Header.Add("Accept", accept)
+		req.Header.Add("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, respBody
+	}
+
+	params := CreateParams{Login: "binpack_user", Name: "Bin Pack", Age: 32}
+	body, _ := params.Pack()
+	resp, respBody := do(http.MethodPost, ApiUserCreate, body, binpackMediaType)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != binpackMediaType {
+		t.Fatalf("create: expected %d %s, got %d %s %q", http.StatusCreated, binpackMediaType, resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+	}
+	created := NewUser{}
+	if err := created.Unpack(respBody); err != nil || created.ID != 43 {
+		t.Errorf("create: bad binpack result %+v: %v", created, err)
+	}
+	if location := resp.Header.Get("Location"); location != "/user/profile?login=binpack_user" {
+		t.Errorf("create: bad Location %q", location)
+	}
+
+	// параметры из binpack проверяются так же, как из формы, и default тоже применяется
+	resp, respBody = do(http.MethodGet, ApiUserProfile+"?login=binpack_user", nil, binpackMediaType)
+	user := User{}
+	if err := user.Unpack(respBody); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("profile: %d %q: %v", resp.StatusCode, respBody, err)
+	}
+	if expected := (User{ID: 43, Login: "binpack_user", FullName: "Bin Pack", Status: api.statuses["user"]}); user != expected {
+		t.Errorf("profile: expected %+v, got %+v", expected, user)
+	}
+
+	// без Accept тот же запрос отвечает json
+	params.Login = "binpack_json_user"
+	body, _ = params.Pack()
+	resp, respBody = do(http.MethodPost, ApiUserCreate, body, "")
+	if resp.StatusCode != http.StatusCreated || string(respBody) != `{"error":"","response":{"id":44}}` {
+		t.Errorf("json result: got %d %s", resp.StatusCode, respBody)
+	}
+
+	params.Login, params.Status = "binpack_admin", "root"
+	body, _ = params.Pack()
+	errorCases := []struct {
+		Body   []byte
+		Status int
+		Error  string
+	}{
+		{body, http.StatusBadRequest, `{"error":"status must be one of [user, moderator, admin]"}`},
+		{body[:5], http.StatusBadRequest, `{"error":"binpack: CreateParams.Login at offset 0: short buffer"}`},
+	}
+	for idx, item := range errorCases {
+		// ошибки binpack не кодирует, они всегда в json
+		resp, respBody = do(http.MethodPost, ApiUserCreate, item.Body, binpackMediaType)
+		if resp.StatusCode != item.Status || string(respBody) != item.Error || resp.Header.Get("Content-Type") != jsonMediaType {
+			t.Errorf("[%d] expected %d %s, got %d %s %s", idx, item.Status, item.Error, resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+		}
+	}
+
+	// у OtherApi binpack нет, а у OtherUser нет формата binpack
+	other := httptest.NewServer(NewOtherApi())
+	defer other.Close()
+	req, _ := http.NewRequest(http.MethodPost, other.URL+ApiUserCreate, strings.NewReader("username=binpack&level=1"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", binpackMediaType)
+	req.Header.Add("X-Auth", "100500")
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("other api: expected %d, got %v %v", http.StatusNotAcceptable, resp, err)
+	}
+}